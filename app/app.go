@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"log"
 	"net"
 	"os"
+	"sort"
 	"strconv"
 	"time"
 
@@ -14,6 +16,7 @@ import (
 	"github.com/glaslos/names/lists"
 
 	"github.com/olekukonko/tablewriter"
+	"github.com/rs/zerolog"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
@@ -36,34 +39,80 @@ func verifyAddr(addr string) error {
 }
 
 func main() {
+	pflag.String("config", "", "Path to a config file, its keys are the flag names and sources for user defined lists")
 	pflag.String("addr", "127.0.0.1:53", "Address the resolver listens on")
-	pflag.String("dns-client-net", "tcp", "Net to use for DNS requests")
-	pflag.Duration("dns-client-timeout", 2*time.Second, "DNS client request timeout")
-	pflag.Duration("cache-expiration", 10*time.Second, "Cache entry expiration in seconds")
-	pflag.Duration("cache-dns-refresh", 60*time.Second, "Cache value refresh in seconds")
+	pflag.String("dns-client-net", "udp", "Transport for upstreams without scheme: udp, tcp or tcp-tls")
+	pflag.Duration("dns-client-timeout", 2*time.Second, "Timeout for upstreams without their own")
+	pflag.Duration("resolve-timeout", 4*time.Second, "Timeout for resolving a query from all upstreams together")
+	pflag.Duration("tcp-idle-timeout", 10*time.Second, "Idle timeout for DNS over TCP connections")
+	pflag.Duration("cache-expiration", 10*time.Second, "Cache entry expiration for answers without records")
+	pflag.Duration("cache-min-ttl", 0, "Minimum TTL of cached answers, 0 for no limit")
+	pflag.Duration("cache-max-ttl", 24*time.Hour, "Maximum TTL of cached answers, 0 for no limit")
+	pflag.Duration("cache-dns-refresh", 60*time.Second, "Interval to refresh cached answers at")
 	pflag.Bool("cache-persist", true, "Set to persist cache to disk")
+	pflag.String("doh-addr", "", "Address to serve DNS over HTTPS on, disabled if empty")
+	pflag.String("dot-addr", "", "Address to serve DNS over TLS on, usually port 853, disabled if empty")
+	pflag.Duration("dot-idle-timeout", 10*time.Second, "Idle timeout for DNS over TLS connections")
+	pflag.Int("dot-max-conns", 100, "Max concurrent DNS over TLS connections, 0 for no limit")
+	pflag.String("tls-cert", "", "Path to the TLS certificate for encrypted listeners")
+	pflag.String("tls-key", "", "Path to the TLS key for encrypted listeners")
 	pflag.String("log-file", "./names.log", "Path to log file")
 	pflag.Int("log-max-size", 50, "Max log file size in MB")
 	pflag.Int("log-file-retention", 3, "Number of log files to keep")
 	pflag.Int("log-max-age", 28, "Max age of log files")
 	pflag.Bool("log-compress", true, "Set to enable log file compression")
+	pflag.Bool("log-queries", false, "Set to log every query with its result and the blocklist entry that blocked it")
 	pflag.StringSlice("fetch-lists", []string{"adguard"}, "Block lists to fetch")
+	pflag.StringSlice("block-files", nil, "Files or directories of files with domains to block, reloaded when they change")
+	pflag.Duration("fetch-lists-interval", 24*time.Hour, "Interval to fetch the block lists again at, 0 to never")
+	pflag.StringSlice("allow", nil, "Domains to never block, *.example.com allows all subdomains of example.com")
+	pflag.StringSlice("allow-files", nil, "Files with domains to never block, one per line")
+	pflag.StringSlice("fetch-allowlists", nil, "Allowlists to fetch, these are listed with the block lists")
+	pflag.String("block-mode", "null", "How to answer blocked queries: null, sinkhole, nxdomain, nodata or refused")
+	pflag.String("block-ipv4", "", "IPv4 address blocked names resolve to in sinkhole mode")
+	pflag.String("block-ipv6", "", "IPv6 address blocked names resolve to in sinkhole mode")
+	pflag.Duration("block-ttl", 5*time.Minute, "TTL of block responses")
 	pflag.Bool("list-blocklists", false, "Set to list all block lists")
+	pflag.String("lookup", "", "Print whether a name is blocked and by which list entries, then exit")
 	pflag.StringSlice("upstreams", []string{"1.1.1.1:53", "9.9.9.9:53", "1.0.0.1:53", "8.8.4.4:53", "8.8.8.8:53"}, "Upstreams to resolve from")
+	pflag.StringSlice("bootstrap", nil, "Resolvers for the hostnames of upstreams, given by IP address, the system resolver if empty")
+	pflag.Duration("bootstrap-interval", 30*time.Minute, "Interval to resolve the hostnames of upstreams again at")
+	pflag.StringSlice("forward", nil, "Send queries for a zone and its subdomains to other upstreams, as zone=upstream")
+	pflag.Int("upstream-max-failures", 3, "Consecutive failures after which an upstream is skipped until it recovers")
+	pflag.Duration("upstream-probe-interval", 10*time.Second, "Interval to probe unhealthy upstreams at")
+	pflag.Duration("upstream-status-interval", 5*time.Minute, "Interval to log the health, counters and latency of every upstream at, 0 to never")
+	pflag.String("upstream-strategy", "race", "How to pick upstreams: race, round-robin, fastest, sequential or random")
 	viper.BindPFlags(pflag.CommandLine)
 	pflag.Parse()
 
+	if path := viper.GetString("config"); path != "" {
+		viper.SetConfigFile(path)
+		if err := viper.ReadInConfig(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var sources map[string]lists.SourceConfig
+	if err := viper.UnmarshalKey("sources", &sources); err != nil {
+		log.Fatal(err)
+	}
+
 	if viper.GetBool("list-blocklists") {
-		listConfigs, err := lists.DecodeConfig()
+		listConfigs, err := lists.Catalog(sources)
 		if err != nil {
 			log.Fatal(err)
 		}
 
 		table := tablewriter.NewWriter(os.Stdout)
-		table.SetHeader([]string{"Name", "Size", "Focus"})
+		table.SetHeader([]string{"Name", "Size", "Focus", "Origin"})
 
-		for name, config := range listConfigs {
-			table.Append([]string{name, config.Size, config.Focus})
+		listNames := make([]string, 0, len(listConfigs))
+		for name := range listConfigs {
+			listNames = append(listNames, name)
+		}
+		sort.Strings(listNames)
+		for _, name := range listNames {
+			config := listConfigs[name]
+			table.Append([]string{name, config.Size, config.Focus, config.From})
 		}
 		table.Render()
 		os.Exit(0)
@@ -76,8 +125,10 @@ func main() {
 	config := names.Config{
 		ListenerAddress: viper.GetString("addr"),
 		CacheConfig: &cache.Config{
-			ExpirationTime:  viper.GetDuration("cache-expiration") * time.Second,
-			RefreshInterval: viper.GetDuration("cache-dns-refresh") * time.Second,
+			ExpirationTime:  viper.GetDuration("cache-expiration"),
+			MinTTL:          viper.GetDuration("cache-min-ttl"),
+			MaxTTL:          viper.GetDuration("cache-max-ttl"),
+			RefreshInterval: viper.GetDuration("cache-dns-refresh"),
 			Persist:         viper.GetBool("cache-persist"),
 			RefreshCache:    true,
 		},
@@ -87,10 +138,54 @@ func main() {
 			MaxBackups: viper.GetInt("log-file-retention"),
 			MaxAge:     viper.GetInt("log-max-age"),
 			Compress:   viper.GetBool("log-compress"),
+			Queries:    viper.GetBool("log-queries"),
+		},
+		DNSClientNet:             viper.GetString("dns-client-net"),
+		DNSClientTimeout:         viper.GetDuration("dns-client-timeout"),
+		ResolveTimeout:           viper.GetDuration("resolve-timeout"),
+		BootstrapResolvers:       viper.GetStringSlice("bootstrap"),
+		BootstrapInterval:        viper.GetDuration("bootstrap-interval"),
+		TCPIdleTimeout:           viper.GetDuration("tcp-idle-timeout"),
+		UpstreamStrategy:         viper.GetString("upstream-strategy"),
+		UpstreamMaxFailures:      viper.GetInt("upstream-max-failures"),
+		UpstreamProbeInterval:    viper.GetDuration("upstream-probe-interval"),
+		UpstreamStatusInterval:   viper.GetDuration("upstream-status-interval"),
+		BlocklistRefreshInterval: viper.GetDuration("fetch-lists-interval"),
+		Sources:                  sources,
+		BlockConfig: &names.BlockConfig{
+			Mode: viper.GetString("block-mode"),
+			IPv4: viper.GetString("block-ipv4"),
+			IPv6: viper.GetString("block-ipv6"),
+			TTL:  viper.GetDuration("block-ttl"),
+		},
+		DoHConfig: &names.DoHConfig{
+			Address:  viper.GetString("doh-addr"),
+			CertFile: viper.GetString("tls-cert"),
+			KeyFile:  viper.GetString("tls-key"),
+		},
+		DoTConfig: &names.DoTConfig{
+			Address:     viper.GetString("dot-addr"),
+			CertFile:    viper.GetString("tls-cert"),
+			KeyFile:     viper.GetString("tls-key"),
+			IdleTimeout: viper.GetDuration("dot-idle-timeout"),
+			MaxConns:    viper.GetInt("dot-max-conns"),
 		},
-		DNSClientNet:     viper.GetString("dns-client-net"),
-		DNSClientTimeout: viper.GetDuration("dns-client-timeout") * time.Second,
 	}
+	if name := viper.GetString("lookup"); name != "" {
+		// only the lists are built, logs go to stderr to keep the output parsable
+		logger := zerolog.New(os.Stderr).With().Timestamp().Logger()
+		match, err := names.LookupLists(&config, &logger, name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(match); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
 	n, err := names.New(context.Background(), &config)
 	if err != nil {
 		log.Fatal(err)
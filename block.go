@@ -0,0 +1,121 @@
+package names
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/phuslu/fastdns"
+)
+
+// Block modes decide how queries for blocked names are answered
+const (
+	// BlockModeNullIP answers A queries with 0.0.0.0, AAAA queries with :: and anything else with NODATA
+	BlockModeNullIP = "null"
+	// BlockModeSinkhole answers A and AAAA queries with the configured addresses and anything else with NODATA
+	BlockModeSinkhole = "sinkhole"
+	// BlockModeNXDomain answers that the name does not exist
+	BlockModeNXDomain = "nxdomain"
+	// BlockModeNoData answers that the name has no records of the queried type
+	BlockModeNoData = "nodata"
+	// BlockModeRefused refuses to answer
+	BlockModeRefused = "refused"
+
+	defaultBlockTTL = 300 * time.Second
+)
+
+// BlockConfig for answering queries for blocked names
+type BlockConfig struct {
+	Mode string
+	// IPv4 and IPv6 are the addresses blocked names resolve to in sinkhole mode
+	IPv4 string
+	IPv6 string
+	// TTL of the records in block responses
+	TTL time.Duration
+}
+
+// blocker builds the responses to queries for blocked names
+type blocker struct {
+	mode string
+	ipv4 netip.Addr
+	ipv6 netip.Addr
+	ttl  uint32
+}
+
+func newBlocker(config *BlockConfig) (*blocker, error) {
+	if config == nil {
+		config = &BlockConfig{}
+	}
+	b := &blocker{mode: config.Mode, ttl: uint32(defaultBlockTTL / time.Second)}
+	if config.TTL > 0 {
+		b.ttl = uint32(config.TTL / time.Second)
+	}
+	switch b.mode {
+	case "", BlockModeNullIP:
+		b.mode = BlockModeNullIP
+		b.ipv4, b.ipv6 = netip.IPv4Unspecified(), netip.IPv6Unspecified()
+	case BlockModeSinkhole:
+		var err error
+		if config.IPv4 != "" {
+			if b.ipv4, err = netip.ParseAddr(config.IPv4); err != nil || !b.ipv4.Is4() {
+				return nil, fmt.Errorf("invalid sinkhole IPv4 address %q", config.IPv4)
+			}
+		}
+		if config.IPv6 != "" {
+			if b.ipv6, err = netip.ParseAddr(config.IPv6); err != nil || !b.ipv6.Is6() || b.ipv6.Is4In6() {
+				return nil, fmt.Errorf("invalid sinkhole IPv6 address %q", config.IPv6)
+			}
+		}
+		if !b.ipv4.IsValid() && !b.ipv6.IsValid() {
+			return nil, fmt.Errorf("sinkhole mode needs an IPv4 or IPv6 address")
+		}
+	case BlockModeNXDomain, BlockModeNoData, BlockModeRefused:
+	default:
+		return nil, fmt.Errorf("unknown block mode %q", b.mode)
+	}
+	return b, nil
+}
+
+// response builds the answer to the query for a blocked name in buf, parsed into req
+func (b *blocker) response(buf []byte, req *fastdns.Message) []byte {
+	switch b.mode {
+	case BlockModeRefused:
+		return errorResponse(buf, fastdns.RcodeRefused)
+	case BlockModeNXDomain:
+		return appendSOA(errorResponse(buf, fastdns.RcodeNXDomain), b.ttl)
+	}
+	var addr netip.Addr
+	if b.mode != BlockModeNoData && req.Question.Class == fastdns.ClassINET {
+		switch req.Question.Type {
+		case fastdns.TypeA:
+			addr = b.ipv4
+		case fastdns.TypeAAAA:
+			addr = b.ipv6
+		}
+	}
+	if !addr.IsValid() {
+		return appendSOA(errorResponse(buf, fastdns.RcodeNoError), b.ttl)
+	}
+	req.SetResponseHeader(fastdns.RcodeNoError, 1)
+	return fastdns.AppendHOSTRecord(req.Raw, req, b.ttl, []netip.Addr{addr})
+}
+
+// appendSOA adds a SOA record for the queried name to the authority section of the negative
+// response raw, so clients cache it for ttl as described in RFC 2308
+func appendSOA(raw []byte, ttl uint32) []byte {
+	if len(raw) < 12 || binary.BigEndian.Uint16(raw[4:]) != 1 {
+		return raw
+	}
+	// the owner points to the question name, the MNAME and RNAME are the root
+	raw = append(raw, 0xC0, 12, 0, byte(dns.TypeSOA), 0, byte(dns.ClassINET))
+	raw = binary.BigEndian.AppendUint32(raw, ttl)
+	raw = append(raw, 0, 22, 0, 0)
+	// serial, refresh, retry, expire and minimum
+	for _, v := range []uint32{1, 1800, 900, 604800, ttl} {
+		raw = binary.BigEndian.AppendUint32(raw, v)
+	}
+	binary.BigEndian.PutUint16(raw[8:], binary.BigEndian.Uint16(raw[8:])+1)
+	return raw
+}
@@ -0,0 +1,78 @@
+package names
+
+import (
+	"testing"
+	"time"
+
+	"github.com/glaslos/names/lists"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewBlocker(t *testing.T) {
+	b, err := newBlocker(nil)
+	require.NoError(t, err)
+	require.Equal(t, BlockModeNullIP, b.mode)
+	require.Equal(t, uint32(300), b.ttl)
+
+	for _, config := range []*BlockConfig{
+		{Mode: "banana"},
+		{Mode: BlockModeSinkhole},
+		{Mode: BlockModeSinkhole, IPv4: "::1"},
+		{Mode: BlockModeSinkhole, IPv6: "192.0.2.1"},
+	} {
+		_, err := newBlocker(config)
+		require.Error(t, err, config)
+	}
+}
+
+func TestBlockModes(t *testing.T) {
+	tests := []struct {
+		config *BlockConfig
+		qtype  uint16
+		rcode  int
+		answer string
+	}{
+		{&BlockConfig{}, dns.TypeA, dns.RcodeSuccess, "0.0.0.0"},
+		{&BlockConfig{}, dns.TypeAAAA, dns.RcodeSuccess, "::"},
+		{&BlockConfig{}, dns.TypeMX, dns.RcodeSuccess, ""},
+		{&BlockConfig{Mode: BlockModeSinkhole, IPv4: "192.0.2.1", IPv6: "2001:db8::1"}, dns.TypeA, dns.RcodeSuccess, "192.0.2.1"},
+		{&BlockConfig{Mode: BlockModeSinkhole, IPv4: "192.0.2.1", IPv6: "2001:db8::1"}, dns.TypeAAAA, dns.RcodeSuccess, "2001:db8::1"},
+		{&BlockConfig{Mode: BlockModeSinkhole, IPv4: "192.0.2.1"}, dns.TypeAAAA, dns.RcodeSuccess, ""},
+		{&BlockConfig{Mode: BlockModeNXDomain}, dns.TypeA, dns.RcodeNameError, ""},
+		{&BlockConfig{Mode: BlockModeNoData}, dns.TypeA, dns.RcodeSuccess, ""},
+		{&BlockConfig{Mode: BlockModeRefused}, dns.TypeA, dns.RcodeRefused, ""},
+	}
+	for _, test := range tests {
+		test.config.TTL = time.Minute
+		n := newTestNames(t, func(cfg *Config) {
+			cfg.BlockConfig = test.config
+		})
+		n.blocklist().Add("ads.example.com", lists.Origin{Source: "test"})
+
+		resp := query(t, n, new(dns.Msg).SetQuestion("ads.example.com.", test.qtype))
+		require.Equal(t, test.rcode, resp.Rcode, test.config)
+		require.Len(t, resp.Question, 1)
+		if test.answer == "" {
+			require.Empty(t, resp.Answer, test.config)
+			if test.rcode != dns.RcodeRefused {
+				// negative answers carry a SOA record with the block TTL for negative caching
+				require.Len(t, resp.Ns, 1)
+				soa := resp.Ns[0].(*dns.SOA)
+				require.Equal(t, uint32(60), soa.Hdr.Ttl)
+				require.Equal(t, uint32(60), soa.Minttl)
+			}
+			continue
+		}
+		require.Len(t, resp.Answer, 1, test.config)
+		require.Equal(t, test.qtype, resp.Answer[0].Header().Rrtype)
+		require.Equal(t, uint32(60), resp.Answer[0].Header().Ttl)
+		switch rr := resp.Answer[0].(type) {
+		case *dns.A:
+			require.Equal(t, test.answer, rr.A.String())
+		case *dns.AAAA:
+			require.Equal(t, test.answer, rr.AAAA.String())
+		}
+	}
+}
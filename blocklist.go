@@ -0,0 +1,132 @@
+package names
+
+import (
+	"time"
+
+	"github.com/glaslos/names/lists"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+)
+
+// blocklist returns the current blocklist
+func (n *Names) blocklist() *lists.List {
+	return n.tree.Load()
+}
+
+// allowlist returns the current allowlist
+func (n *Names) allowlist() *lists.List {
+	return n.allow.Load()
+}
+
+// updateBlocklists builds new block and allowlists and swaps them for the current ones, so lookups never see
+// a half built list and removed entries are dropped. Unless fetch is set the lists are read from their copies on
+// disk. Updates are serialized, so the latest one always wins.
+func (n *Names) updateBlocklists(fetch bool) error {
+	n.listsMu.Lock()
+	defer n.listsMu.Unlock()
+	blocklist, allowlist, err := n.buildLists(fetch)
+	if err != nil {
+		return err
+	}
+	if err := lists.Dump(blocklist); err != nil {
+		return err
+	}
+	n.tree.Store(blocklist)
+	n.allow.Store(allowlist)
+	return nil
+}
+
+// buildLists fetches the configured block and allowlists and reads the block and allow files into new lists.
+// Unless fetch is set the sources are read from their copies on disk, if there are any.
+func (n *Names) buildLists(fetch bool) (blocklist, allowlist *lists.List, err error) {
+	populate := n.fetcher.PopulateFromDisk
+	if fetch {
+		populate = n.fetcher.PopulateCache
+	}
+	blocklist = lists.NewList()
+	if err := populate(blocklist, viper.GetStringSlice("fetch-lists"), n.Log); err != nil {
+		return nil, nil, err
+	}
+	if err := n.loadBlockFiles(blocklist); err != nil {
+		return nil, nil, err
+	}
+	if allowlist, err = n.makeAllowlist(populate); err != nil {
+		return nil, nil, err
+	}
+	return blocklist, allowlist, nil
+}
+
+// LookupLists builds the lists configured in config and looks name up in them, without starting a resolver.
+// Sources are read from their copies on disk and only fetched if there are none, nothing else is written.
+func LookupLists(config *Config, log *zerolog.Logger, name string) (ListMatch, error) {
+	if _, err := lists.Catalog(config.Sources); err != nil {
+		return ListMatch{}, errors.Wrap(err, "invalid list sources")
+	}
+	n := &Names{
+		config:  config,
+		Log:     log,
+		fetcher: &lists.Fetcher{Sources: config.Sources},
+	}
+	blocklist, allowlist, err := n.buildLists(false)
+	if err != nil {
+		return ListMatch{}, err
+	}
+	n.tree.Store(blocklist)
+	n.allow.Store(allowlist)
+	return n.LookupLists(name), nil
+}
+
+// refreshBlocklists periodically updates the blocklists, the current ones stay in place if that fails
+func (n *Names) refreshBlocklists() {
+	ticker := time.NewTicker(n.config.BlocklistRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := n.updateBlocklists(true); err != nil {
+			n.Log.Error().Err(err).Msg("failed to refresh blocklists, keeping the current ones")
+			continue
+		}
+		n.Log.Info().Msg("refreshed blocklists")
+	}
+}
+
+// loadBlockFiles adds the domains in the configured block files and directories to blocklist
+func (n *Names) loadBlockFiles(blocklist *lists.List) error {
+	for _, path := range viper.GetStringSlice("block-files") {
+		count, err := lists.LoadPath(blocklist, path)
+		if err != nil {
+			return err
+		}
+		n.Log.Debug().Str("file", path).Msgf("added %d blocked domains", count)
+	}
+	return nil
+}
+
+// watchBlockFiles updates the blocklists whenever one of the block files changes,
+// other sources are read from their copies on disk
+func (n *Names) watchBlockFiles() error {
+	paths := viper.GetStringSlice("block-files")
+	if len(paths) == 0 {
+		return nil
+	}
+	watcher, err := lists.NewWatcher(paths)
+	if err != nil {
+		return err
+	}
+	n.background(func() {
+		watcher.Run(n.ctx, func() {
+			if err := n.updateBlocklists(false); err != nil {
+				n.Log.Error().Err(err).Msg("failed to reload block files, keeping the current blocklists")
+				return
+			}
+			n.Log.Info().Msg("reloaded block files")
+		})
+	})
+	return nil
+}
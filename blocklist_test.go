@@ -0,0 +1,182 @@
+package names
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/glaslos/names/cache"
+	"github.com/glaslos/names/lists"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateBlocklists(t *testing.T) {
+	n := newTestNames(t)
+	current := n.blocklist()
+	current.Add("doubleclick.net", lists.Origin{Source: "test"})
+	require.NotNil(t, n.LookupLists("ad.doubleclick.net").Block)
+
+	// lookups keep working while the lists are swapped
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				n.LookupLists("ad.doubleclick.net")
+			}
+		}
+	}()
+	require.NoError(t, n.updateBlocklists(true))
+	close(done)
+	<-stopped
+
+	// no source lists the entry anymore
+	require.NotSame(t, current, n.blocklist())
+	require.Nil(t, n.LookupLists("ad.doubleclick.net").Block)
+
+	// concurrent updates, e.g. by the refresh and a changed block file, don't corrupt the dump
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(fetch bool) {
+			defer wg.Done()
+			require.NoError(t, n.updateBlocklists(fetch))
+		}(i%2 == 0)
+	}
+	wg.Wait()
+	_, err := lists.Load()
+	require.NoError(t, err)
+}
+
+func TestStartupIgnoresDump(t *testing.T) {
+	stale := lists.NewList()
+	stale.Add("stale.example.com", lists.Origin{Source: "removed"})
+	require.NoError(t, lists.Dump(stale))
+
+	// the lists are built from the sources only, the dump of the last run is replaced
+	n := newTestNames(t)
+	require.Nil(t, n.LookupLists("stale.example.com").Block)
+	dumped, err := lists.Load()
+	require.NoError(t, err)
+	_, ok := dumped.MatchDomain("stale.example.com")
+	require.False(t, ok)
+}
+
+func TestBlockFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	require.NoError(t, os.WriteFile(path, []byte("0.0.0.0 ads.example.com\n"), 0o600))
+	viper.Set("block-files", []string{path})
+	t.Cleanup(func() { viper.Set("block-files", nil) })
+
+	n := newTestNames(t)
+	require.NotNil(t, n.LookupLists("ads.example.com").Block)
+
+	// changes are picked up without a restart
+	require.NoError(t, os.WriteFile(path, []byte("||tracker.example.net^\n"), 0o600))
+	require.Eventually(t, func() bool {
+		return n.LookupLists("x.tracker.example.net").Block != nil && n.LookupLists("ads.example.com").Block == nil
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestUserSources(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	require.NoError(t, os.WriteFile(path, []byte("0.0.0.0 ads.example.com\n"), 0o600))
+	viper.Set("fetch-lists", []string{"internal"})
+	t.Cleanup(func() { viper.Set("fetch-lists", nil) })
+
+	n := newTestNames(t, func(cfg *Config) {
+		cfg.Sources = map[string]lists.SourceConfig{"internal": {Url: "file://" + path}}
+	})
+	match := n.LookupLists("ads.example.com")
+	require.True(t, match.Blocked)
+	require.Equal(t, []lists.Origin{{Source: "internal", Line: 1}}, match.Block.Origins)
+}
+
+func TestRefreshAllowlists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allow")
+	require.NoError(t, os.WriteFile(path, []byte("ads.example.com\n"), 0o600))
+	viper.Set("fetch-allowlists", []string{"internal"})
+	t.Cleanup(func() { viper.Set("fetch-allowlists", nil) })
+
+	n := newTestNames(t, func(cfg *Config) {
+		cfg.Sources = map[string]lists.SourceConfig{"internal": {Url: "file://" + path}}
+	})
+	require.NotNil(t, n.LookupLists("ads.example.com").Allow)
+
+	// fetched allowlists are updated with the blocklists
+	require.NoError(t, os.WriteFile(path, []byte("tracker.example.net\n"), 0o600))
+	require.NoError(t, n.updateBlocklists(true))
+	require.Nil(t, n.LookupLists("ads.example.com").Allow)
+	require.NotNil(t, n.LookupLists("tracker.example.net").Allow)
+}
+
+func TestLookupListsWithoutResolver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	require.NoError(t, os.WriteFile(path, []byte("0.0.0.0 ads.example.com\n"), 0o600))
+	viper.Set("block-files", []string{path})
+	t.Cleanup(func() { viper.Set("block-files", nil) })
+	require.NoError(t, os.RemoveAll("lists.dump"))
+
+	log := zerolog.Nop()
+	match, err := LookupLists(&Config{}, &log, "x.ads.example.com")
+	require.NoError(t, err)
+	require.True(t, match.Blocked)
+	require.Equal(t, []lists.Origin{{Source: path, Line: 1}}, match.Block.Origins)
+
+	// nothing is dumped
+	_, err = os.Stat("lists.dump")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestBlockCachedNames(t *testing.T) {
+	n := newTestNames(t)
+	n.tree.Store(lists.NewList())
+	var queries atomic.Int32
+	withUpstream(t, n, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		resp := new(dns.Msg).SetReply(r)
+		a, _ := dns.NewRR(r.Question[0].Name + " 3600 IN A 192.0.2.1")
+		resp.Answer = append(resp.Answer, a)
+		w.WriteMsg(resp)
+	})
+	key := cache.Key{Name: "ads.example.com", Type: dns.TypeA, Class: dns.ClassINET}
+	resp := query(t, n, new(dns.Msg).SetQuestion("ads.example.com.", dns.TypeA))
+	require.Equal(t, "192.0.2.1", resp.Answer[0].(*dns.A).A.String())
+	require.Eventually(t, func() bool {
+		_, ok := n.cache.Get(key)
+		return ok
+	}, time.Second, 10*time.Millisecond)
+
+	// names are blocked as soon as the lists list them, cached answers or not
+	blocklist := lists.NewList()
+	blocklist.Add("ads.example.com", lists.Origin{Source: "test"})
+	n.tree.Store(blocklist)
+	resp = query(t, n, new(dns.Msg).SetQuestion("ads.example.com.", dns.TypeA))
+	require.Equal(t, "0.0.0.0", resp.Answer[0].(*dns.A).A.String())
+
+	// and unblocked as soon as they are removed
+	n.tree.Store(lists.NewList())
+	resp = query(t, n, new(dns.Msg).SetQuestion("ads.example.com.", dns.TypeA))
+	require.Equal(t, "192.0.2.1", resp.Answer[0].(*dns.A).A.String())
+
+	// from the cache
+	require.EqualValues(t, 1, queries.Load())
+
+	// blocked names and block responses cached by earlier versions are not refreshed, even when they're due
+	n.config.CacheConfig.RefreshInterval = 2 * time.Hour
+	n.tree.Store(blocklist)
+	n.cache.Set(cache.Key{Name: "old.example.com", Type: dns.TypeA, Class: dns.ClassINET}, cache.Element{Resolver: blockResolver, TTL: time.Minute})
+	n.refreshCacheFunc(n.cache)
+	require.EqualValues(t, 1, queries.Load())
+}
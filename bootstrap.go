@@ -0,0 +1,173 @@
+package names
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/phuslu/fastdns"
+)
+
+// defaultBootstrapInterval is how often the hostnames of upstreams are resolved again
+const defaultBootstrapInterval = 30 * time.Minute
+
+// bootstrap resolves the hostnames of upstreams through resolvers given by IP address
+type bootstrap struct {
+	resolvers []*Upstream
+	timeout   time.Duration
+
+	mu      sync.Mutex
+	clients []*bootstrapClient
+}
+
+// newBootstrap creates a bootstrap from the resolver definitions, plain DNS resolvers have to
+// be given by IP address. It returns nil if there are no resolvers.
+func newBootstrap(resolvers []string, timeout time.Duration) (*bootstrap, error) {
+	if len(resolvers) == 0 {
+		return nil, nil
+	}
+	if timeout == 0 {
+		timeout = defaultUpstreamTimeout
+	}
+	b := &bootstrap{timeout: timeout}
+	for _, resolver := range resolvers {
+		u, err := newUpstream(resolver, upstreamConfig{timeout: timeout})
+		if err != nil {
+			return nil, fmt.Errorf("invalid bootstrap resolver %s: %w", resolver, err)
+		}
+		b.resolvers = append(b.resolvers, u)
+	}
+	return b, nil
+}
+
+// lookup returns the first IPv4 address of host, or its first IPv6 address if it has no IPv4 address
+func (b *bootstrap) lookup(host string) (netip.Addr, error) {
+	for _, qtype := range []fastdns.Type{fastdns.TypeA, fastdns.TypeAAAA} {
+		req := &fastdns.Message{}
+		req.SetRequestQuestion(host, qtype, fastdns.ClassINET)
+		ctx, cancel := context.WithTimeout(context.Background(), b.timeout*time.Duration(len(b.resolvers)))
+		element, err := failover(ctx, req, b.resolvers, exchange)
+		cancel()
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		var addr netip.Addr
+		_ = walkRecords(element.Msg, func(rr record) bool {
+			if rr.section != sectionAnswer {
+				return false
+			}
+			rdata := element.Msg[rr.hdr+10 : rr.end]
+			switch {
+			case rr.typ == dns.TypeA && len(rdata) == net.IPv4len:
+				addr = netip.AddrFrom4([4]byte(rdata))
+			case rr.typ == dns.TypeAAAA && len(rdata) == net.IPv6len:
+				addr = netip.AddrFrom16([16]byte(rdata))
+			}
+			return !addr.IsValid()
+		})
+		if addr.IsValid() {
+			return addr, nil
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("no address found for %s", host)
+}
+
+// newClient resolves host and returns a client for it which is kept up to date by refresh
+func (b *bootstrap) newClient(host string, port uint16, dial func(addr string) (exchanger, error)) (*bootstrapClient, error) {
+	c := &bootstrapClient{host: host, port: port, dial: dial}
+	if err := c.resolve(b); err != nil {
+		return nil, fmt.Errorf("bootstrap %s: %w", host, err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.clients = append(b.clients, c)
+	return c, nil
+}
+
+// refresh resolves the hostnames of all upstreams again. Upstreams which fail to resolve
+// keep their previous address.
+func (b *bootstrap) refresh() error {
+	b.mu.Lock()
+	clients := append([]*bootstrapClient(nil), b.clients...)
+	b.mu.Unlock()
+	var errs []error
+	for _, c := range clients {
+		if err := c.resolve(b); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.host, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// bootstrapClient exchanges DNS messages with an upstream given by hostname.
+// The client is replaced whenever the hostname resolves to another address.
+type bootstrapClient struct {
+	host string
+	port uint16
+	dial func(addr string) (exchanger, error)
+
+	mu     sync.RWMutex
+	addr   netip.Addr
+	client exchanger
+}
+
+// Exchange sends req to the current address of the upstream
+func (c *bootstrapClient) Exchange(ctx context.Context, req, resp *fastdns.Message) error {
+	c.mu.RLock()
+	client := c.client
+	c.mu.RUnlock()
+	return client.Exchange(ctx, req, resp)
+}
+
+// Addr is the address the hostname of the upstream resolved to
+func (c *bootstrapClient) Addr() netip.Addr {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.addr
+}
+
+func (c *bootstrapClient) resolve(b *bootstrap) error {
+	addr, err := b.lookup(c.host)
+	if err != nil {
+		return err
+	}
+	if addr == c.Addr() {
+		return nil
+	}
+	client, err := c.dial(net.JoinHostPort(addr.String(), strconv.Itoa(int(c.port))))
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	old := c.client
+	c.addr, c.client = addr, client
+	c.mu.Unlock()
+	// exchanges still using the old client finish, its connections are closed after them
+	if closer, ok := old.(io.Closer); ok {
+		closer.Close()
+	}
+	return nil
+}
+
+// refreshBootstrap periodically resolves the hostnames of upstreams again
+func (n *Names) refreshBootstrap() {
+	ticker := time.NewTicker(n.config.BootstrapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := n.bootstrap.refresh(); err != nil {
+			n.Log.Error().Err(err).Msg("failed to resolve upstreams again, keeping their previous address")
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package names
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/phuslu/fastdns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBootstrap(t *testing.T) {
+	upstream := newFakeUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg).SetReply(r)
+		a, _ := dns.NewRR("example.com. 60 IN A 192.0.2.1")
+		resp.Answer = append(resp.Answer, a)
+		w.WriteMsg(resp)
+	})
+	var ip atomic.Value
+	ip.Store("127.0.0.1")
+	resolver := newFakeUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg).SetReply(r)
+		if r.Question[0].Name == "dns.test." && r.Question[0].Qtype == dns.TypeA {
+			a, _ := dns.NewRR("dns.test. 60 IN A " + ip.Load().(string))
+			resp.Answer = append(resp.Answer, a)
+		}
+		w.WriteMsg(resp)
+	})
+
+	_, err := newUpstream("dns.test", upstreamConfig{})
+	require.Error(t, err)
+
+	b, err := newBootstrap([]string{resolver}, 0)
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(upstream)
+	require.NoError(t, err)
+	u, err := newUpstream("dns.test:"+port, upstreamConfig{bootstrap: b})
+	require.NoError(t, err)
+
+	req := &fastdns.Message{}
+	req.SetRequestQuestion("example.com", fastdns.TypeA, fastdns.ClassINET)
+	_, err = exchange(context.Background(), req, u)
+	require.NoError(t, err)
+
+	// a new address is picked up on refresh and the connections to the old one are closed
+	client := u.client.(*bootstrapClient)
+	old := client.client.(*udpClient)
+	require.Len(t, old.conns, 1)
+	ip.Store("127.0.0.2")
+	require.NoError(t, b.refresh())
+	require.Equal(t, "127.0.0.2", client.Addr().String())
+	require.Empty(t, old.conns)
+	require.True(t, old.closed)
+
+	// startup fails if a hostname can't be resolved
+	_, err = newUpstream("tls://missing.test", upstreamConfig{bootstrap: b})
+	require.ErrorContains(t, err, "bootstrap missing.test")
+}
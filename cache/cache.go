@@ -2,6 +2,8 @@ package cache
 
 import (
 	"encoding/gob"
+	"errors"
+	"io/fs"
 	"os"
 	"sync"
 	"time"
@@ -9,10 +11,23 @@ import (
 	"github.com/miekg/dns"
 )
 
+// Key identifies a cached response by its question and the query bits that change the answer
+type Key struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	// DO and CD are the DNSSEC OK and Checking Disabled bits of the query
+	DO bool
+	CD bool
+}
+
 // Element in the cache
 type Element struct {
-	Value     string
-	Refresh   bool
+	// Msg is the packed DNS response
+	Msg     []byte
+	Refresh bool
+	// TTL is the lowest TTL of the records in Msg, zero if it has none
+	TTL       time.Duration
 	TimeAdded time.Time
 	Resolver  string
 	Request   []byte
@@ -20,7 +35,11 @@ type Element struct {
 
 // Config for the cache
 type Config struct {
-	ExpirationTime  time.Duration
+	// ExpirationTime applies to elements without a TTL
+	ExpirationTime time.Duration
+	// MinTTL and MaxTTL clamp the TTL of elements, zero means no limit
+	MinTTL          time.Duration
+	MaxTTL          time.Duration
 	RefreshInterval time.Duration
 	RefreshFunc     func(cache *Cache)
 	Persist         bool
@@ -30,7 +49,7 @@ type Config struct {
 
 // Cache struct
 type Cache struct {
-	Elements map[string]Element
+	Elements map[Key]Element
 	mutex    sync.RWMutex
 	config   *Config
 }
@@ -60,7 +79,16 @@ func (cache *Cache) Load(path string) error {
 	defer fh.Close()
 	gob.Register(dns.A{})
 	gob.Register(dns.CNAME{})
-	return gob.NewDecoder(fh).Decode(&cache.Elements)
+	if err := gob.NewDecoder(fh).Decode(&cache.Elements); err != nil {
+		return err
+	}
+	// drop entries from older dumps that didn't store the full response
+	for k, element := range cache.Elements {
+		if len(element.Msg) == 0 {
+			delete(cache.Elements, k)
+		}
+	}
+	return nil
 }
 
 func (cache *Cache) refresh() {
@@ -82,15 +110,17 @@ func (cache *Cache) dump() {
 // New initializes the cache
 func New(config Config) (*Cache, error) {
 	cache := &Cache{
-		Elements: make(map[string]Element),
+		Elements: make(map[Key]Element),
 		config:   &config,
 	}
 	if config.Persist {
 		if err := cache.Load("cache.dump"); err != nil {
-			if !os.IsNotExist(err) {
+			var pathErr *fs.PathError
+			if errors.As(err, &pathErr) && !os.IsNotExist(err) {
 				return cache, err
 			}
-			// Ignoring error of missing cache dump
+			// Ignoring error of missing cache dump and dumps in an outdated format
+			cache.Elements = make(map[Key]Element)
 		}
 		if config.DumpInterval == 0 {
 			config.DumpInterval = 60 * time.Second
@@ -104,28 +134,82 @@ func New(config Config) (*Cache, error) {
 }
 
 // Get an element from the cache
-func (cache *Cache) Get(k string) (*Element, bool) {
+func (cache *Cache) Get(k Key) (*Element, bool) {
 	cache.mutex.RLock()
 	defer cache.mutex.RUnlock()
 
 	element, found := cache.Elements[k]
-	if !found {
+	if !found || cache.expired(element, time.Now()) {
 		return nil, false
 	}
-	if cache.config.ExpirationTime > 0 {
-		// adding the negative expiration time
-		if time.Now().Add(time.Duration(-cache.config.ExpirationTime)).After(element.TimeAdded) {
-			return nil, false
+	return &element, true
+}
+
+// Expires returns when element expires, the zero time if it never does
+func (cache *Cache) Expires(element *Element) time.Time {
+	ttl := element.TTL
+	if ttl == 0 {
+		ttl = cache.config.ExpirationTime
+	}
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return element.TimeAdded.Add(ttl)
+}
+
+func (cache *Cache) expired(element Element, now time.Time) bool {
+	expires := cache.Expires(&element)
+	return !expires.IsZero() && now.After(expires)
+}
+
+// Live deletes the expired elements and returns a copy of the others,
+// which can be iterated while the cache is written to
+func (cache *Cache) Live() map[Key]Element {
+	now := time.Now()
+	live := make(map[Key]Element)
+	var expired []Key
+	cache.mutex.RLock()
+	for k, element := range cache.Elements {
+		if cache.expired(element, now) {
+			expired = append(expired, k)
+			continue
+		}
+		live[k] = element
+	}
+	cache.mutex.RUnlock()
+
+	if len(expired) > 0 {
+		cache.mutex.Lock()
+		for _, k := range expired {
+			// the element might have been set again in the meantime
+			if element, ok := cache.Elements[k]; ok && cache.expired(element, now) {
+				delete(cache.Elements, k)
+			}
 		}
+		cache.mutex.Unlock()
 	}
-	return &element, true
+	return live
+}
+
+// ClampTTL limits ttl to the configured minimum and maximum
+func (config *Config) ClampTTL(ttl time.Duration) time.Duration {
+	if config.MinTTL > 0 && ttl < config.MinTTL {
+		ttl = config.MinTTL
+	}
+	if config.MaxTTL > 0 && ttl > config.MaxTTL {
+		ttl = config.MaxTTL
+	}
+	return ttl
 }
 
 // Set an element in the cache
-func (cache *Cache) Set(k string, v Element) {
+func (cache *Cache) Set(k Key, v Element) {
 	cache.mutex.Lock()
 
 	v.TimeAdded = time.Now()
+	if v.TTL > 0 {
+		v.TTL = cache.config.ClampTTL(v.TTL)
+	}
 	cache.Elements[k] = v
 
 	cache.mutex.Unlock()
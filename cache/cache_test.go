@@ -9,15 +9,24 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+func packedResponse(t *testing.T) []byte {
+	rr, err := dns.NewRR("test. 3600 IN A 127.0.0.1")
+	require.NoError(t, err)
+	msg := new(dns.Msg).SetQuestion("test.", dns.TypeA)
+	msg.Response = true
+	msg.Answer = append(msg.Answer, rr)
+	buf, err := msg.Pack()
+	require.NoError(t, err)
+	return buf
+}
+
 func TestCache(t *testing.T) {
 	cache, err := New(Config{ExpirationTime: 10 * time.Second})
 	require.NoError(t, err)
-	rr, err := dns.NewRR("test. 3600 IN A 127.0.0.1")
-	require.NoError(t, err)
-	element := &Element{Value: rr.String()}
-	cache.Set("1", *element)
+	element := &Element{Msg: packedResponse(t)}
+	cache.Set(Key{Name: "1"}, *element)
 	var ok bool
-	element, ok = cache.Get("1")
+	element, ok = cache.Get(Key{Name: "1"})
 	require.True(t, ok)
 	require.NotNil(t, element)
 }
@@ -26,10 +35,8 @@ func TestSaveAndLoad(t *testing.T) {
 	config := Config{ExpirationTime: 10 * time.Second}
 	cache, err := New(config)
 	require.NoError(t, err)
-	rr, err := dns.NewRR("test. 3600 IN A 127.0.0.1")
-	require.NoError(t, err)
-	element := &Element{Value: rr.String()}
-	cache.Set("1", *element)
+	element := &Element{Msg: packedResponse(t)}
+	cache.Set(Key{Name: "1"}, *element)
 	err = cache.Save("test.dump")
 	require.NoError(t, err)
 	defer func() {
@@ -41,9 +48,54 @@ func TestSaveAndLoad(t *testing.T) {
 	err = cache.Load("test.dump")
 	require.NoError(t, err)
 	var ok bool
-	element, ok = cache.Get("1")
+	element, ok = cache.Get(Key{Name: "1"})
 	require.True(t, ok)
 	require.NotNil(t, element)
-	require.NotEmpty(t, element.Value)
-	require.Equal(t, "test.\t3600\tIN\tA\t127.0.0.1", element.Value)
+	require.NotEmpty(t, element.Msg)
+	msg := new(dns.Msg)
+	require.NoError(t, msg.Unpack(element.Msg))
+	require.Equal(t, "test.\t3600\tIN\tA\t127.0.0.1", msg.Answer[0].String())
+}
+
+func TestKey(t *testing.T) {
+	cache, err := New(Config{})
+	require.NoError(t, err)
+	a := Key{Name: "test", Type: dns.TypeA, Class: dns.ClassINET}
+	cache.Set(a, Element{Msg: packedResponse(t)})
+	_, ok := cache.Get(a)
+	require.True(t, ok)
+	_, ok = cache.Get(Key{Name: "test", Type: dns.TypeAAAA, Class: dns.ClassINET})
+	require.False(t, ok)
+	_, ok = cache.Get(Key{Name: "test", Type: dns.TypeA, Class: dns.ClassINET, DO: true})
+	require.False(t, ok)
+}
+
+func TestTTLExpiry(t *testing.T) {
+	cache, err := New(Config{ExpirationTime: time.Hour, MinTTL: 50 * time.Millisecond})
+	require.NoError(t, err)
+	cache.Set(Key{Name: "1"}, Element{Msg: packedResponse(t), TTL: time.Millisecond})
+	element, ok := cache.Get(Key{Name: "1"})
+	require.True(t, ok)
+	require.Equal(t, 50*time.Millisecond, element.TTL)
+	time.Sleep(60 * time.Millisecond)
+	_, ok = cache.Get(Key{Name: "1"})
+	require.False(t, ok)
+}
+
+func TestLive(t *testing.T) {
+	cache, err := New(Config{ExpirationTime: time.Hour})
+	require.NoError(t, err)
+	cache.Set(Key{Name: "expired"}, Element{Msg: packedResponse(t), TTL: time.Millisecond})
+	cache.Set(Key{Name: "live"}, Element{Msg: packedResponse(t), TTL: time.Hour})
+	time.Sleep(10 * time.Millisecond)
+
+	live := cache.Live()
+	require.Len(t, live, 1)
+	require.Contains(t, live, Key{Name: "live"})
+	// expired elements are deleted
+	require.Len(t, cache.Elements, 1)
+
+	// the copy is not affected by later writes
+	cache.Set(Key{Name: "new"}, Element{Msg: packedResponse(t), TTL: time.Hour})
+	require.Len(t, live, 1)
 }
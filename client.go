@@ -1,67 +1,270 @@
 package names
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"net"
 	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/glaslos/names/cache"
 
+	"github.com/miekg/dns"
 	"github.com/phuslu/fastdns"
 )
 
-func (n *Names) resolv(req *fastdns.Message, upstream *Upstream, dataCh chan cache.Element, stopCh chan struct{}) {
+// exchange queries a single upstream and returns its answer as cache element.
+// Exchanges cancelled because the query was answered otherwise don't count against the upstream.
+func exchange(ctx context.Context, req *fastdns.Message, upstream *Upstream) (cache.Element, error) {
 	resp := fastdns.AcquireMessage()
 	defer fastdns.ReleaseMessage(resp)
-	if err := upstream.client.Exchange(req, resp); err != nil {
-		n.Log.Error().Err(err).Str("resolver", upstream.addr).Msg("failed to exchange DNS request")
-		return
+	// make room for answers up to the payload size the client advertised
+	if cap(resp.Raw) < dns.MaxMsgSize {
+		resp.Raw = make([]byte, 0, dns.MaxMsgSize)
+	}
+	start := time.Now()
+	err := upstream.client.Exchange(ctx, req, resp)
+	if err == nil {
+		err = checkResponse(req, resp)
+	}
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		return cache.Element{}, err
+	}
+	upstream.observe(time.Since(start), err)
+	if err != nil {
+		return cache.Element{}, err
 	}
 
-	select {
-	case <-stopCh:
-		return
-	default:
-		_ = resp.Walk(func(name []byte, typ fastdns.Type, class fastdns.Class, ttl uint32, data []byte) bool {
-			var v netip.Addr
-			switch typ {
-			case fastdns.TypeA, fastdns.TypeAAAA:
-				v, _ = netip.AddrFromSlice(data)
-				element := cache.Element{Value: v.String(), Resolver: upstream.addr, Request: req.Raw}
-				dataCh <- element
-			}
-			return true
-		})
+	element := cache.Element{
+		Msg:      append([]byte(nil), resp.Raw...),
+		Resolver: upstream.addr,
+		Request:  req.Raw,
+	}
+	if isNegative(resp) {
+		// negative answers without a SOA record keep a zero TTL and are not cached
+		element.TTL, _ = negativeTTL(element.Msg)
+	} else {
+		element.TTL = minTTL(element.Msg)
 	}
+	return element, nil
 }
 
+// checkResponse verifies that resp answers req, so no answer to another question is cached.
+// Negative answers are valid answers, any other error rcode means the upstream failed us.
+func checkResponse(req, resp *fastdns.Message) error {
+	if resp.Header.ID != req.Header.ID {
+		return errors.New("response id mismatch")
+	}
+	if rcode := resp.Header.Flags.Rcode(); rcode != fastdns.RcodeNoError && rcode != fastdns.RcodeNXDomain {
+		return fmt.Errorf("upstream answered with rcode %d", rcode)
+	}
+	if !bytes.EqualFold(resp.Domain, req.Domain) || resp.Question.Type != req.Question.Type || resp.Question.Class != req.Question.Class {
+		return errors.New("response question mismatch")
+	}
+	return nil
+}
+
+// resolveUpstream asks the upstreams for an answer to msg as the configured strategy sees fit
 func (n *Names) resolveUpstream(msg *fastdns.Message) (cache.Element, error) {
-	dataCh := make(chan cache.Element)
-	stopCh := make(chan struct{})
-	for _, upstream := range n.dnsUpstreams {
-		go n.resolv(msg, upstream, dataCh, stopCh)
-	}
-	ticker := time.NewTicker(4 * time.Second)
-	select {
-	case <-ticker.C:
-		return cache.Element{}, errors.New("resolve upstream timeout")
-	case element := <-dataCh:
-		ticker.Stop()
-		close(stopCh)
-		return element, nil
+	zone, upstreams := n.upstreamsFor(string(msg.Domain))
+	if len(upstreams) == 0 {
+		return cache.Element{}, errors.New("no upstreams configured")
+	}
+	// upstreams may still be busy after we returned, hand them a copy they own
+	req := &fastdns.Message{}
+	if err := fastdns.ParseMessage(req, msg.Raw, true); err != nil {
+		return cache.Element{}, err
 	}
+	ctx, cancel := context.WithTimeout(n.ctx, n.config.ResolveTimeout)
+	defer cancel()
+	return n.strategy.resolve(ctx, req, n.healthyUpstreams(upstreams), func(ctx context.Context, req *fastdns.Message, upstream *Upstream) (cache.Element, error) {
+		element, err := exchange(ctx, req, upstream)
+		if err != nil {
+			n.Log.Error().Err(err).Str("resolver", upstream.addr).Str("zone", zone).Msg("failed to exchange DNS request")
+			if upstream.ConsecutiveFailures() == n.config.UpstreamMaxFailures {
+				n.Log.Warn().Str("resolver", upstream.addr).Msg("upstream marked unhealthy")
+			}
+		}
+		return element, err
+	})
 }
 
-func newClient(server string, port int16) (*fastdns.Client, error) {
-	addr, err := netip.ParseAddr(server)
+const (
+	// defaultUpstreamTimeout limits how long to wait for a single upstream
+	defaultUpstreamTimeout = 2 * time.Second
+	// defaultResolveTimeout limits how long to wait for all upstreams together
+	defaultResolveTimeout = 4 * time.Second
+)
+
+// exchanger sends a DNS request to an upstream and reads its response, giving up
+// after the timeout of the upstream or when ctx is done, whichever comes first
+type exchanger interface {
+	Exchange(ctx context.Context, req, resp *fastdns.Message) error
+}
+
+// deadline returns when an exchange with timeout has to be done under ctx
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	d := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(d) {
+		return ctxDeadline
+	}
+	return d
+}
+
+// upstreamConfig holds the defaults for upstreams which don't set their own
+type upstreamConfig struct {
+	// net is the transport of upstreams without scheme: udp, tcp or tcp-tls
+	net     string
+	timeout time.Duration
+	// bootstrap resolves the hostnames of upstreams, if nil only DoT and DoH upstreams
+	// may have hostnames and they are resolved by the system
+	bootstrap *bootstrap
+}
+
+// upstreamConfig returns the upstream defaults from the config
+func (n *Names) upstreamConfig() upstreamConfig {
+	return upstreamConfig{net: n.config.DNSClientNet, timeout: n.config.DNSClientTimeout, bootstrap: n.bootstrap}
+}
+
+// newUpstream parses an upstream definition. Plain host:port upstreams use the default transport,
+// udp:// and tcp:// upstreams plain DNS, where truncated UDP answers are retried over TCP,
+// tls://host:port#servername (or tcp-tls://) DNS over TLS where the optional fragment sets the name
+// the certificate is verified against and https:// URLs DNS over HTTPS.
+// An optional ?timeout=duration overrides the default timeout and an optional @weight suffix
+// sets the weight used by the random strategy.
+func newUpstream(upstream string, defaults upstreamConfig) (*Upstream, error) {
+	if defaults.net == "" {
+		defaults.net = "udp"
+	}
+	if defaults.timeout == 0 {
+		defaults.timeout = defaultUpstreamTimeout
+	}
+	weight := 1
+	if i := strings.LastIndex(upstream, "@"); i > 0 {
+		if w, err := strconv.Atoi(upstream[i+1:]); err == nil {
+			if w < 1 {
+				return nil, errors.New("weight must be at least 1")
+			}
+			upstream, weight = upstream[:i], w
+		}
+	}
+	upstream, timeout, err := cutTimeout(upstream, defaults.timeout)
 	if err != nil {
 		return nil, err
 	}
-	client := &fastdns.Client{
-		AddrPort:     netip.AddrPortFrom(addr, uint16(port)),
-		ReadTimeout:  2 * time.Second,
-		MaxConns:     100,
-		MaxIdleConns: 20,
+	client, err := newExchanger(upstream, defaults, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Upstream{addr: upstream, client: client, weight: weight, timeout: timeout}, nil
+}
+
+// cutTimeout removes the timeout option from upstream and returns it, or timeout if there is none.
+// Other query parameters are kept as they belong to DNS over HTTPS URLs.
+func cutTimeout(upstream string, timeout time.Duration) (string, time.Duration, error) {
+	base, query, found := strings.Cut(upstream, "?")
+	if !found {
+		return upstream, timeout, nil
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "", 0, err
+	}
+	if v := values.Get("timeout"); v != "" {
+		if timeout, err = time.ParseDuration(v); err != nil || timeout <= 0 {
+			return "", 0, fmt.Errorf("invalid timeout %q", v)
+		}
+		values.Del("timeout")
+	}
+	if len(values) > 0 {
+		base += "?" + values.Encode()
+	}
+	return base, timeout, nil
+}
+
+// newExchanger creates the client for upstream. Upstreams given by hostname are
+// resolved through the bootstrap resolvers.
+func newExchanger(upstream string, defaults upstreamConfig, timeout time.Duration) (exchanger, error) {
+	scheme, rest, found := strings.Cut(upstream, "://")
+	if !found {
+		scheme, rest = defaults.net, upstream
+	}
+	var host string
+	var port uint16
+	var err error
+	// dial creates the client for the upstream at addr
+	var dial func(addr string) (exchanger, error)
+	switch scheme {
+	case "udp", "tcp":
+		if host, port, err = splitHostPort(rest, 53); err != nil {
+			return nil, err
+		}
+		dial = func(addr string) (exchanger, error) {
+			if _, err := netip.ParseAddrPort(addr); err != nil {
+				return nil, err
+			}
+			if scheme == "tcp" {
+				return newTCPClient(addr, timeout), nil
+			}
+			return newUDPClient(addr, timeout), nil
+		}
+	case "tls", "tcp-tls":
+		hostport, serverName, _ := strings.Cut(rest, "#")
+		if host, port, err = splitHostPort(hostport, 853); err != nil {
+			return nil, err
+		}
+		if serverName == "" {
+			serverName = host
+		}
+		dial = func(addr string) (exchanger, error) {
+			return newTLSClient(addr, serverName, timeout), nil
+		}
+	case "https":
+		u, err := url.Parse(upstream)
+		if err != nil {
+			return nil, err
+		}
+		if u.Host == "" {
+			return nil, errors.New("missing host")
+		}
+		if host, port, err = splitHostPort(u.Host, 443); err != nil {
+			return nil, err
+		}
+		hostport := net.JoinHostPort(host, strconv.Itoa(int(port)))
+		dial = func(addr string) (exchanger, error) {
+			return newHTTPSClient(u.String(), hostport, addr, timeout), nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme %q", scheme)
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return dial(net.JoinHostPort(host, strconv.Itoa(int(port))))
+	}
+	if defaults.bootstrap != nil {
+		return defaults.bootstrap.newClient(host, port, dial)
+	}
+	if scheme == "udp" || scheme == "tcp" {
+		return nil, fmt.Errorf("%s is not an IP address and there are no bootstrap resolvers", host)
+	}
+	// DoT and DoH clients can leave it to the system
+	return dial(net.JoinHostPort(host, strconv.Itoa(int(port))))
+}
+
+// splitHostPort splits addr into host and port, using defaultPort if addr has none
+func splitHostPort(addr string, defaultPort uint16) (string, uint16, error) {
+	host, sport, err := net.SplitHostPort(addr)
+	if err != nil {
+		// no port given
+		return strings.Trim(addr, "[]"), defaultPort, nil
+	}
+	port, err := strconv.ParseUint(sport, 10, 16)
+	if err != nil {
+		return "", 0, err
 	}
-	return client, nil
+	return host, uint16(port), nil
 }
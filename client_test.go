@@ -0,0 +1,269 @@
+package names
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/phuslu/fastdns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewUpstream(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream string
+		doesErr  bool
+	}{
+		{"udp", "1.1.1.1:53", false},
+		{"udp scheme", "udp://1.1.1.1", false},
+		{"tls", "tls://1.1.1.1:853#cloudflare-dns.com", false},
+		{"tls default port", "tls://9.9.9.9", false},
+		{"bad port", "1.1.1.1:banana", true},
+		{"https", "https://dns.example/dns-query", false},
+		{"https without host", "https:///dns-query", true},
+		{"unknown scheme", "quic://1.1.1.1", true},
+		{"tcp", "tcp://1.1.1.1", false},
+		{"tcp-tls", "tcp-tls://1.1.1.1#cloudflare-dns.com", false},
+		{"bad timeout", "1.1.1.1?timeout=banana", true},
+		{"negative timeout", "1.1.1.1?timeout=-1s", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			u, err := newUpstream(test.upstream, upstreamConfig{})
+			if test.doesErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.upstream, u.addr)
+		})
+	}
+
+	u, err := newUpstream("tls://1.1.1.1#cloudflare-dns.com", upstreamConfig{})
+	require.NoError(t, err)
+	client := u.client.(*tcpClient)
+	require.Equal(t, "1.1.1.1:853", client.addr)
+	require.Equal(t, "cloudflare-dns.com", client.config.ServerName)
+
+	// plain upstreams use the default transport and timeout unless they set their own
+	u, err = newUpstream("1.1.1.1", upstreamConfig{net: "tcp", timeout: time.Second})
+	require.NoError(t, err)
+	require.Nil(t, u.client.(*tcpClient).config)
+	require.Equal(t, time.Second, u.timeout)
+
+	u, err = newUpstream("udp://1.1.1.1?timeout=500ms@2", upstreamConfig{net: "tcp"})
+	require.NoError(t, err)
+	require.Equal(t, "udp://1.1.1.1", u.addr)
+	require.Equal(t, 500*time.Millisecond, u.client.(*udpClient).timeout)
+	require.Equal(t, 2, u.weight)
+
+	u, err = newUpstream("https://dns.example/dns-query?timeout=1s&ct=1", upstreamConfig{})
+	require.NoError(t, err)
+	require.Equal(t, "https://dns.example/dns-query?ct=1", u.client.(*httpsClient).url)
+	require.Equal(t, time.Second, u.client.(*httpsClient).client.Timeout)
+}
+
+func TestTruncatedRetry(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	pc, err := net.ListenPacket("udp", ln.Addr().String())
+	require.NoError(t, err)
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg).SetReply(r)
+		if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+			resp.Truncated = true
+		} else {
+			a, _ := dns.NewRR("example.com. 60 IN A 192.0.2.1")
+			resp.Answer = append(resp.Answer, a)
+		}
+		w.WriteMsg(resp)
+	})
+	for _, server := range []*dns.Server{{Listener: ln, Handler: handler}, {PacketConn: pc, Handler: handler}} {
+		go server.ActivateAndServe()
+		t.Cleanup(func() { server.Shutdown() })
+	}
+
+	u, err := newUpstream(ln.Addr().String(), upstreamConfig{})
+	require.NoError(t, err)
+	req := &fastdns.Message{}
+	req.SetRequestQuestion("example.com", fastdns.TypeA, fastdns.ClassINET)
+	element, err := exchange(context.Background(), req, u)
+	require.NoError(t, err)
+	resp := new(dns.Msg)
+	require.NoError(t, resp.Unpack(element.Msg))
+	require.False(t, resp.Truncated)
+	require.Len(t, resp.Answer, 1)
+}
+
+func TestExchangeMismatch(t *testing.T) {
+	var calls atomic.Int32
+	addr := newFakeUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg).SetReply(r)
+		switch r.Question[0].Name {
+		case "id.example.com.":
+			resp.Id++
+		case "question.example.com.":
+			resp.Question[0].Name = "evil.example."
+			a, _ := dns.NewRR("evil.example. 60 IN A 6.6.6.6")
+			resp.Answer = append(resp.Answer, a)
+		case "late.example.com.":
+			if calls.Add(1) == 1 {
+				// the answer to the first query arrives after the client gave up
+				time.Sleep(150 * time.Millisecond)
+			}
+			a, _ := dns.NewRR("late.example.com. 60 IN A 192.0.2.1")
+			resp.Answer = append(resp.Answer, a)
+		}
+		w.WriteMsg(resp)
+	})
+
+	u, err := newUpstream("udp://"+addr+"?timeout=100ms", upstreamConfig{})
+	require.NoError(t, err)
+	for _, name := range []string{"id.example.com", "question.example.com"} {
+		req := &fastdns.Message{}
+		req.SetRequestQuestion(name, fastdns.TypeA, fastdns.ClassINET)
+		_, err := exchange(context.Background(), req, u)
+		require.Error(t, err, name)
+	}
+
+	// the late answer to the first query is not taken for the answer to the second
+	req := &fastdns.Message{}
+	req.SetRequestQuestion("late.example.com", fastdns.TypeA, fastdns.ClassINET)
+	_, err = exchange(context.Background(), req, u)
+	require.Error(t, err)
+	time.Sleep(100 * time.Millisecond)
+	req.Header.ID++
+	binary.BigEndian.PutUint16(req.Raw, req.Header.ID)
+	element, err := exchange(context.Background(), req, u)
+	require.NoError(t, err)
+	resp := new(dns.Msg)
+	require.NoError(t, resp.Unpack(element.Msg))
+	require.Equal(t, req.Header.ID, resp.Id)
+}
+
+func TestExchangeTimeout(t *testing.T) {
+	// an upstream which never answers
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	u, err := newUpstream("udp://"+pc.LocalAddr().String()+"?timeout=200ms", upstreamConfig{})
+	require.NoError(t, err)
+	req := &fastdns.Message{}
+	req.SetRequestQuestion("example.com", fastdns.TypeA, fastdns.ClassINET)
+	start := time.Now()
+	_, err = exchange(context.Background(), req, u)
+	require.Error(t, err)
+	require.Less(t, time.Since(start), 300*time.Millisecond)
+
+	// the deadline of the query cuts the timeout of the upstream short
+	u, err = newUpstream("udp://"+pc.LocalAddr().String()+"?timeout=2s", upstreamConfig{})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = failover(ctx, req, []*Upstream{u, u}, exchange)
+	require.Error(t, err)
+	require.Less(t, time.Since(start), 400*time.Millisecond)
+}
+
+func TestTLSClient(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	n := newTestNames(t, func(cfg *Config) {
+		cfg.DoTConfig = &DoTConfig{Address: "127.0.0.1:0", CertFile: certFile, KeyFile: keyFile}
+	})
+	go n.serveDoT()
+
+	pem, err := os.ReadFile(certFile)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(pem))
+
+	req := &fastdns.Message{}
+	req.SetRequestQuestion("local", fastdns.TypeA, fastdns.ClassINET)
+
+	client := newTLSClient(n.DoT.Addr().String(), "localhost", time.Second)
+	client.config.RootCAs = roots
+	for i := 0; i < 2; i++ {
+		resp := &fastdns.Message{}
+		require.NoError(t, client.Exchange(context.Background(), req, resp))
+		require.Equal(t, req.Header.ID, resp.Header.ID)
+		require.Equal(t, uint16(1), resp.Header.ANCount)
+	}
+	// the connection is reused for the second exchange
+	require.Len(t, client.conns, 1)
+
+	// no silent fallback if the certificate doesn't match
+	client = newTLSClient(n.DoT.Addr().String(), "example.com", time.Second)
+	client.config.RootCAs = roots
+	require.Error(t, client.Exchange(context.Background(), req, &fastdns.Message{}))
+}
+
+func TestHTTPSClient(t *testing.T) {
+	n := newTestNames(t)
+	var protos []int
+	mux := http.NewServeMux()
+	mux.HandleFunc(dohPath, func(w http.ResponseWriter, r *http.Request) {
+		protos = append(protos, r.ProtoMajor)
+		n.handleDoH(w, r)
+	})
+	ts := httptest.NewUnstartedServer(mux)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	u, err := newUpstream(ts.URL+dohPath, upstreamConfig{})
+	require.NoError(t, err)
+	client := u.client.(*httpsClient)
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	client.client.Transport.(*http.Transport).TLSClientConfig.RootCAs = roots
+
+	req := &fastdns.Message{}
+	req.SetRequestQuestion("local", fastdns.TypeA, fastdns.ClassINET)
+	for i := 0; i < 2; i++ {
+		resp := &fastdns.Message{}
+		require.NoError(t, client.Exchange(context.Background(), req, resp))
+		require.Equal(t, req.Header.ID, resp.Header.ID)
+		require.Equal(t, uint16(1), resp.Header.ANCount)
+	}
+	require.Equal(t, []int{2, 2}, protos)
+
+	u, err = newUpstream(ts.URL+"/missing", upstreamConfig{})
+	require.NoError(t, err)
+	u.client.(*httpsClient).client.Transport.(*http.Transport).TLSClientConfig.RootCAs = roots
+	require.Error(t, u.client.Exchange(context.Background(), req, &fastdns.Message{}))
+}
+
+// newFakeUpstream starts a local UDP DNS server answering with handler and returns its address
+func newFakeUpstream(t *testing.T, handler dns.HandlerFunc) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestParseForward(t *testing.T) {
+	zone, u, err := parseForward("10.In-Addr.Arpa.=tls://10.0.0.53#dns.corp.internal", upstreamConfig{})
+	require.NoError(t, err)
+	require.Equal(t, "10.in-addr.arpa", zone)
+	require.IsType(t, &tcpClient{}, u.client)
+
+	for _, rule := range []string{"corp.internal", "=10.0.0.53", "corp.internal=", "corp.internal=ftp://10.0.0.53"} {
+		_, _, err := parseForward(rule, upstreamConfig{})
+		require.Error(t, err, rule)
+	}
+}
@@ -1,31 +1,289 @@
 package names
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"net"
-	"strings"
+	"net/http"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/phuslu/fastdns"
 )
 
-func (n *Names) newTLSConnection(ctx context.Context, network, address string, timeout time.Duration) (*dns.Conn, error) {
-	tlsDialer := tls.Dialer{
-		NetDialer: &net.Dialer{
-			Timeout:   timeout,
-			KeepAlive: 15 * time.Second,
+// connPool keeps the connections to an upstream open between requests. Connections
+// are only put back after a successful exchange, so no late answer can be read from them.
+type connPool struct {
+	// maxIdleConns limits the number of connections kept open between requests
+	maxIdleConns int
+
+	mu     sync.Mutex
+	conns  []net.Conn
+	closed bool
+}
+
+func (p *connPool) get() net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.conns) == 0 {
+		return nil
+	}
+	conn := p.conns[len(p.conns)-1]
+	p.conns = p.conns[:len(p.conns)-1]
+	return conn
+}
+
+func (p *connPool) put(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || len(p.conns) >= p.maxIdleConns {
+		conn.Close()
+		return
+	}
+	p.conns = append(p.conns, conn)
+}
+
+// Close closes the idle connections, connections still in use are closed when they are put back
+func (p *connPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+	return nil
+}
+
+// interruptOnDone unblocks I/O on conn once ctx is done. The returned func stops that and
+// sets *err to the error of ctx if the I/O was interrupted.
+func interruptOnDone(ctx context.Context, conn net.Conn, err *error) func() {
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	return func() {
+		if !stop() && ctx.Err() != nil {
+			*err = ctx.Err()
+		}
+	}
+}
+
+// tcpClient exchanges DNS messages with an upstream over pooled TCP connections,
+// or DNS over TLS connections if config is set
+type tcpClient struct {
+	connPool
+	addr    string
+	config  *tls.Config
+	timeout time.Duration
+}
+
+func newTCPClient(addr string, timeout time.Duration) *tcpClient {
+	return &tcpClient{
+		connPool: connPool{maxIdleConns: 20},
+		addr:     addr,
+		timeout:  timeout,
+	}
+}
+
+func newTLSClient(addr, serverName string, timeout time.Duration) *tcpClient {
+	c := newTCPClient(addr, timeout)
+	c.config = &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	return c
+}
+
+func (c *tcpClient) dial(ctx context.Context, deadline time.Time) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Deadline:  deadline,
+		KeepAlive: 15 * time.Second,
+	}
+	if c.config == nil {
+		return dialer.DialContext(ctx, "tcp", c.addr)
+	}
+	return (&tls.Dialer{NetDialer: dialer, Config: c.config}).DialContext(ctx, "tcp", c.addr)
+}
+
+// Exchange sends req over a pooled connection and reads the answer into resp.
+// A pooled connection the upstream has closed in the meantime is replaced once.
+func (c *tcpClient) Exchange(ctx context.Context, req, resp *fastdns.Message) error {
+	deadline := deadline(ctx, c.timeout)
+	if conn := c.get(); conn != nil {
+		if err := c.exchange(ctx, conn, deadline, req, resp); err == nil {
+			c.put(conn)
+			return nil
+		}
+		conn.Close()
+	}
+	conn, err := c.dial(ctx, deadline)
+	if err != nil {
+		return err
+	}
+	if err := c.exchange(ctx, conn, deadline, req, resp); err != nil {
+		conn.Close()
+		return err
+	}
+	c.put(conn)
+	return nil
+}
+
+func (c *tcpClient) exchange(ctx context.Context, conn net.Conn, deadline time.Time, req, resp *fastdns.Message) (err error) {
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	defer interruptOnDone(ctx, conn, &err)()
+	if err := writeTCPMsg(conn, req.Raw); err != nil {
+		return err
+	}
+	buf, err := readTCPMsg(conn)
+	if err != nil {
+		return err
+	}
+	resp.Raw = append(resp.Raw[:0], buf...)
+	if err := fastdns.ParseMessage(resp, resp.Raw, false); err != nil {
+		return err
+	}
+	if resp.Header.ID != req.Header.ID {
+		return errors.New("response id mismatch")
+	}
+	return nil
+}
+
+// udpClient exchanges DNS messages with an upstream over pooled UDP sockets.
+// Truncated answers are retried over TCP to get the full answer.
+type udpClient struct {
+	connPool
+	addr    string
+	timeout time.Duration
+	tcp     *tcpClient
+}
+
+func newUDPClient(addr string, timeout time.Duration) *udpClient {
+	return &udpClient{
+		connPool: connPool{maxIdleConns: 20},
+		addr:     addr,
+		timeout:  timeout,
+		tcp:      newTCPClient(addr, timeout),
+	}
+}
+
+// Exchange sends req once and waits for the answer until the deadline, there are no retries.
+// Sockets which failed, e.g. because the answer took too long, are closed so a late answer
+// is never read for another request.
+func (c *udpClient) Exchange(ctx context.Context, req, resp *fastdns.Message) error {
+	deadline := deadline(ctx, c.timeout)
+	conn := c.get()
+	if conn == nil {
+		var err error
+		dialer := &net.Dialer{Deadline: deadline}
+		if conn, err = dialer.DialContext(ctx, "udp", c.addr); err != nil {
+			return err
+		}
+	}
+	if err := c.exchange(ctx, conn, deadline, req, resp); err != nil {
+		conn.Close()
+		return err
+	}
+	c.put(conn)
+	if resp.Header.Flags.TC() == 0 {
+		return nil
+	}
+	return c.tcp.Exchange(ctx, req, resp)
+}
+
+// Close closes the idle UDP sockets and TCP connections
+func (c *udpClient) Close() error {
+	c.tcp.Close()
+	return c.connPool.Close()
+}
+
+func (c *udpClient) exchange(ctx context.Context, conn net.Conn, deadline time.Time, req, resp *fastdns.Message) (err error) {
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	defer interruptOnDone(ctx, conn, &err)()
+	if _, err := conn.Write(req.Raw); err != nil {
+		return err
+	}
+	buf := resp.Raw[:cap(resp.Raw)]
+	if len(buf) < dns.MaxMsgSize {
+		buf = make([]byte, dns.MaxMsgSize)
+	}
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		resp.Raw = buf[:n]
+		// anything but the answer to req, e.g. a duplicate answer, is skipped
+		if fastdns.ParseMessage(resp, resp.Raw, false) == nil && checkResponse(req, resp) == nil {
+			return nil
+		}
+	}
+}
+
+// httpsClient exchanges DNS messages with a RFC 8484 DNS over HTTPS upstream.
+// Connections are kept alive and multiplexed over HTTP/2 where the upstream supports it.
+type httpsClient struct {
+	url    string
+	client *http.Client
+}
+
+// newHTTPSClient creates a client for the upstream at url. Connections to the host:port
+// of url go to addr instead, so it can be resolved by other means than the system resolver.
+func newHTTPSClient(url, hostport, addr string, timeout time.Duration) *httpsClient {
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: 15 * time.Second}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			// proxies are dialed as they are
+			if address == hostport {
+				address = addr
+			}
+			return dialer.DialContext(ctx, network, address)
 		},
-		Config: &tls.Config{},
+		ForceAttemptHTTP2:   true,
+		TLSClientConfig:     &tls.Config{MinVersion: tls.VersionTLS12},
+		TLSHandshakeTimeout: timeout,
+		MaxIdleConnsPerHost: 20,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &httpsClient{
+		url:    url,
+		client: &http.Client{Transport: transport, Timeout: timeout},
 	}
+}
+
+// Close closes the idle connections
+func (c *httpsClient) Close() error {
+	c.client.CloseIdleConnections()
+	return nil
+}
 
-	// attempt TLS connection
-	conn, err := tlsDialer.DialContext(ctx, network, address)
+// Exchange posts req to the upstream and reads the answer into resp
+func (c *httpsClient) Exchange(ctx context.Context, req, resp *fastdns.Message) error {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(req.Raw))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", dohMediaType)
+	r.Header.Set("Accept", dohMediaType)
+	res, err := c.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	buf, err := io.ReadAll(io.LimitReader(res.Body, dns.MaxMsgSize))
 	if err != nil {
-		n.Log.Warn().Err(err).Msg("failed to dial")
-	} else {
-		return &dns.Conn{Conn: conn}, nil
+		return err
 	}
-	// fallback to UDP
-	return dns.DialTimeout("udp", strings.Split(address, ":")[0]+":53", timeout)
+	resp.Raw = append(resp.Raw[:0], buf...)
+	return fastdns.ParseMessage(resp, resp.Raw, false)
 }
@@ -0,0 +1,104 @@
+package names
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dohPath      = "/dns-query"
+	dohMediaType = "application/dns-message"
+)
+
+// DoHConfig for serving DNS over HTTPS
+type DoHConfig struct {
+	Address  string
+	CertFile string
+	KeyFile  string
+}
+
+// createDoHServer returns a HTTPS server answering DNS queries on /dns-query and its listener
+func (n *Names) createDoHServer(config *DoHConfig) (*http.Server, net.Listener, error) {
+	tlsConfig, err := loadTLSConfig(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	ln, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		return nil, nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(dohPath, n.handleDoH)
+	server := &http.Server{
+		Handler:           mux,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: n.config.TCPIdleTimeout,
+		IdleTimeout:       n.config.TCPIdleTimeout,
+	}
+	return server, ln, nil
+}
+
+// serveDoH serves DNS over HTTPS until the server is closed
+func (n *Names) serveDoH(ln net.Listener) {
+	if err := n.DoH.ServeTLS(ln, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		n.Log.Print(err)
+	}
+	n.Log.Print("doh server closed")
+}
+
+// readDoHQuery extracts the wire format query from a RFC 8484 GET or POST request
+func readDoHQuery(r *http.Request) ([]byte, int, error) {
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			return nil, http.StatusBadRequest, errors.New("missing dns parameter")
+		}
+		// the parameter is unpadded but be lenient with clients that pad anyway
+		buf, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		return buf, http.StatusOK, nil
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohMediaType {
+			return nil, http.StatusUnsupportedMediaType, errors.New("unsupported content type")
+		}
+		buf, err := io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize+1))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if len(buf) > dns.MaxMsgSize {
+			return nil, http.StatusRequestEntityTooLarge, errors.New("query too large")
+		}
+		return buf, http.StatusOK, nil
+	}
+	return nil, http.StatusMethodNotAllowed, errors.New("method not allowed")
+}
+
+func (n *Names) handleDoH(w http.ResponseWriter, r *http.Request) {
+	buf, status, err := readDoHQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	var written bool
+	err = n.handle(buf, false, func(data []byte) error {
+		written = true
+		w.Header().Set("Content-Type", dohMediaType)
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		n.Log.Error().Err(err).Msg("failed to handle request")
+		if !written {
+			http.Error(w, "failed to resolve query", http.StatusInternalServerError)
+		}
+	}
+}
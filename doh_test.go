@@ -0,0 +1,56 @@
+package names
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoH(t *testing.T) {
+	n := newTestNames(t)
+	msg := new(dns.Msg).SetQuestion("local.", dns.TypeA)
+	msg.Id = 0
+	buf, err := msg.Pack()
+	require.NoError(t, err)
+
+	get := httptest.NewRequest(http.MethodGet, dohPath+"?dns="+base64.RawURLEncoding.EncodeToString(buf), nil)
+	post := httptest.NewRequest(http.MethodPost, dohPath, bytes.NewReader(buf))
+	post.Header.Set("Content-Type", dohMediaType)
+
+	for _, r := range []*http.Request{get, post} {
+		rec := httptest.NewRecorder()
+		n.handleDoH(rec, r)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, dohMediaType, rec.Header().Get("Content-Type"))
+		resp := new(dns.Msg)
+		require.NoError(t, resp.Unpack(rec.Body.Bytes()))
+		require.Len(t, resp.Answer, 1)
+		require.Equal(t, "127.0.0.1", resp.Answer[0].(*dns.A).A.String())
+	}
+}
+
+func TestDoHBadRequests(t *testing.T) {
+	n := newTestNames(t)
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"missing param", httptest.NewRequest(http.MethodGet, dohPath, nil), http.StatusBadRequest},
+		{"bad base64", httptest.NewRequest(http.MethodGet, dohPath+"?dns=!!", nil), http.StatusBadRequest},
+		{"wrong content type", httptest.NewRequest(http.MethodPost, dohPath, nil), http.StatusUnsupportedMediaType},
+		{"wrong method", httptest.NewRequest(http.MethodPut, dohPath, nil), http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			n.handleDoH(rec, test.req)
+			require.Equal(t, test.status, rec.Code)
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package names
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// DoTConfig for serving DNS over TLS
+type DoTConfig struct {
+	Address     string
+	CertFile    string
+	KeyFile     string
+	IdleTimeout time.Duration
+	MaxConns    int
+}
+
+// loadTLSConfig returns a server TLS config using the given certificate and key
+func loadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// CreateDoTListener returns a TLS listener
+func CreateDoTListener(config *DoTConfig) (net.Listener, error) {
+	tlsConfig, err := loadTLSConfig(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", config.Address, tlsConfig)
+}
+
+// serveDoT accepts DNS over TLS connections
+func (n *Names) serveDoT() {
+	n.serveStream(n.DoT, n.config.DoTConfig.IdleTimeout, n.config.DoTConfig.MaxConns)
+	n.Log.Print("dot loop closed")
+}
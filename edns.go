@@ -0,0 +1,87 @@
+package names
+
+import (
+	"encoding/binary"
+
+	"github.com/miekg/dns"
+	"github.com/phuslu/fastdns"
+)
+
+// ednsUDPSize is the UDP payload size names advertises, as recommended by DNS flag day 2020
+const ednsUDPSize = 1232
+
+// edns holds the EDNS0 parameters of a query
+type edns struct {
+	udpSize uint16
+	do      bool
+}
+
+// parseEDNS looks for the OPT record in the additional section of msg.
+// ok is false if the query did not use EDNS0 or could not be walked.
+func parseEDNS(msg *fastdns.Message) (opt edns, ok bool) {
+	_ = walkRecords(msg.Raw, func(rr record) bool {
+		if rr.section != sectionAdditional || rr.typ != dns.TypeOPT {
+			return true
+		}
+		// the class holds the payload size and the TTL the extended flags
+		opt.udpSize = binary.BigEndian.Uint16(msg.Raw[rr.hdr+2:])
+		opt.do = msg.Raw[rr.hdr+6]&0x80 != 0
+		ok = true
+		return false
+	})
+	return opt, ok
+}
+
+// maxResponseSize is the largest response the client accepts over the given transport
+func maxResponseSize(udp bool, opt edns, hasOPT bool) int {
+	switch {
+	case !udp:
+		return dns.MaxMsgSize
+	case !hasOPT:
+		return dns.MinMsgSize
+	}
+	return max(dns.MinMsgSize, min(int(opt.udpSize), ednsUDPSize))
+}
+
+// setOPT replaces the OPT record of the response raw with one advertising our payload size,
+// or drops it if the query did not use EDNS0. The extended rcode of the response is kept.
+func setOPT(raw []byte, hasOPT, do bool) []byte {
+	if len(raw) < 12 {
+		return raw
+	}
+	var start, end int
+	var extRcode byte
+	_ = walkRecords(raw, func(rr record) bool {
+		if rr.section != sectionAdditional || rr.typ != dns.TypeOPT {
+			return true
+		}
+		start, end, extRcode = rr.start, rr.end, raw[rr.hdr+4]
+		return false
+	})
+	arcount := binary.BigEndian.Uint16(raw[10:])
+	if end > 0 {
+		raw = append(raw[:start], raw[end:]...)
+		arcount--
+	}
+	if hasOPT {
+		var flags byte
+		if do {
+			flags = 0x80
+		}
+		// root name, type, payload size, extended rcode, version, flags and no options
+		raw = append(raw, 0, 0, byte(dns.TypeOPT), ednsUDPSize>>8, ednsUDPSize&0xFF, extRcode, 0, flags, 0, 0, 0)
+		arcount++
+	}
+	binary.BigEndian.PutUint16(raw[10:], arcount)
+	return raw
+}
+
+// truncate drops records from raw until it fits into size and sets the TC bit
+func truncate(raw []byte, size int) ([]byte, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(raw); err != nil {
+		return nil, err
+	}
+	msg.Truncate(size)
+	return msg.Pack()
+}
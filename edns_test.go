@@ -0,0 +1,74 @@
+package names
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/phuslu/fastdns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEDNS(t *testing.T) {
+	msg := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	buf, err := msg.Pack()
+	require.NoError(t, err)
+	req := &fastdns.Message{}
+	require.NoError(t, fastdns.ParseMessage(req, buf, true))
+	_, ok := parseEDNS(req)
+	require.False(t, ok)
+	require.Equal(t, dns.MinMsgSize, maxResponseSize(true, edns{}, false))
+
+	buf, err = msg.SetEdns0(4096, true).Pack()
+	require.NoError(t, err)
+	require.NoError(t, fastdns.ParseMessage(req, buf, true))
+	opt, ok := parseEDNS(req)
+	require.True(t, ok)
+	require.Equal(t, uint16(4096), opt.udpSize)
+	require.True(t, opt.do)
+	require.Equal(t, ednsUDPSize, maxResponseSize(true, opt, true))
+	require.Equal(t, dns.MaxMsgSize, maxResponseSize(false, opt, true))
+}
+
+func TestSetOPT(t *testing.T) {
+	msg := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	buf, err := msg.Pack()
+	require.NoError(t, err)
+	require.NoError(t, msg.Unpack(setOPT(buf, true, true)))
+	opt := msg.IsEdns0()
+	require.NotNil(t, opt)
+	require.Equal(t, uint16(ednsUDPSize), opt.UDPSize())
+	require.True(t, opt.Do())
+
+	// an upstream OPT record is replaced, not duplicated
+	msg = new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	buf, err = msg.SetEdns0(4096, false).Pack()
+	require.NoError(t, err)
+	require.NoError(t, msg.Unpack(setOPT(buf, true, false)))
+	require.Len(t, msg.Extra, 1)
+	require.Equal(t, uint16(ednsUDPSize), msg.IsEdns0().UDPSize())
+
+	// and dropped for clients without EDNS0
+	buf, err = msg.Pack()
+	require.NoError(t, err)
+	require.NoError(t, msg.Unpack(setOPT(buf, false, false)))
+	require.Nil(t, msg.IsEdns0())
+}
+
+func TestTruncate(t *testing.T) {
+	msg := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 100; i++ {
+		rr, err := dns.NewRR(fmt.Sprintf("example.com. 300 IN A 10.0.0.%d", i))
+		require.NoError(t, err)
+		msg.Answer = append(msg.Answer, rr)
+	}
+	buf, err := msg.Pack()
+	require.NoError(t, err)
+	require.Greater(t, len(buf), dns.MinMsgSize)
+
+	buf, err = truncate(buf, dns.MinMsgSize)
+	require.NoError(t, err)
+	require.LessOrEqual(t, len(buf), dns.MinMsgSize)
+	require.NoError(t, msg.Unpack(buf))
+	require.True(t, msg.Truncated)
+}
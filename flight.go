@@ -0,0 +1,45 @@
+package names
+
+import (
+	"sync"
+
+	"github.com/glaslos/names/cache"
+)
+
+// flightGroup deduplicates concurrent upstream lookups of the same question
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[cache.Key]*flight
+}
+
+// flight is an upstream lookup in progress
+type flight struct {
+	done    chan struct{}
+	element cache.Element
+	err     error
+}
+
+// do calls resolve for key unless a lookup of key is already in flight,
+// then it waits for that lookup and shares its result
+func (g *flightGroup) do(key cache.Key, resolve func() (cache.Element, error)) (cache.Element, error) {
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		<-f.done
+		return f.element, f.err
+	}
+	if g.flights == nil {
+		g.flights = make(map[cache.Key]*flight)
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	f.element, f.err = resolve()
+
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	close(f.done)
+	return f.element, f.err
+}
@@ -0,0 +1,46 @@
+package names
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// parseForward parses a forwarding rule of the form zone=upstream
+func parseForward(rule string, defaults upstreamConfig) (zone string, upstream *Upstream, err error) {
+	zone, addr, ok := strings.Cut(rule, "=")
+	zone = strings.ToLower(strings.Trim(zone, "."))
+	if !ok || zone == "" || addr == "" {
+		return "", nil, fmt.Errorf("expected zone=upstream, got %q", rule)
+	}
+	upstream, err = newUpstream(addr, defaults)
+	return zone, upstream, err
+}
+
+// makeForwards creates the upstreams of the forwarding rules.
+// Rules for the same zone add to its upstream group.
+func (n *Names) makeForwards() error {
+	n.forwards = make(map[string][]*Upstream)
+	for _, rule := range viper.GetStringSlice("forward") {
+		zone, upstream, err := parseForward(rule, n.upstreamConfig())
+		if err != nil {
+			return fmt.Errorf("invalid forwarding rule: %w", err)
+		}
+		n.forwards[zone] = append(n.forwards[zone], upstream)
+	}
+	return nil
+}
+
+// upstreamsFor returns the upstream group of the longest zone domain belongs to,
+// or the default upstreams if no forwarding rule matches
+func (n *Names) upstreamsFor(domain string) (zone string, upstreams []*Upstream) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for domain != "" {
+		if upstreams, ok := n.forwards[domain]; ok {
+			return domain, upstreams
+		}
+		_, domain, _ = strings.Cut(domain, ".")
+	}
+	return "", n.dnsUpstreams
+}
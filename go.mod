@@ -2,6 +2,7 @@ module github.com/glaslos/names
 
 require (
 	github.com/benhoyt/goawk v1.25.0
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/glaslos/trie v0.0.0-20231126130453-7ffb9d45e423
 	github.com/miekg/dns v1.1.56
 	github.com/olekukonko/tablewriter v0.0.5
@@ -18,7 +19,6 @@ go 1.21.2
 
 require (
 	github.com/davecgh/go-spew v1.1.2-0.20180830191138-d8f796af33cc // indirect
-	github.com/fsnotify/fsnotify v1.7.0 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
 	github.com/magiconair/properties v1.8.7 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
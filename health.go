@@ -0,0 +1,184 @@
+package names
+
+import (
+	"sort"
+	"time"
+
+	"github.com/phuslu/fastdns"
+)
+
+const (
+	// ewmaWeight is the weight of a new latency sample in the moving average
+	ewmaWeight = 0.3
+
+	defaultUpstreamMaxFailures   = 3
+	defaultUpstreamProbeInterval = 10 * time.Second
+
+	// probeDomain is queried to check on unhealthy upstreams, fastdns can't parse queries for the root zone
+	probeDomain = "example.com"
+)
+
+// UpstreamStatus is a snapshot of an upstream's health
+type UpstreamStatus struct {
+	Addr string
+	// Zone the upstream is forwarded to, empty for the default upstreams
+	Zone                string
+	Healthy             bool
+	Successes           uint64
+	Failures            uint64
+	ConsecutiveFailures int
+	Latency             time.Duration
+	LastError           string
+}
+
+// observe records the outcome and duration of an exchange.
+// Failures count as taking the full timeout of the upstream in the latency average.
+func (u *Upstream) observe(d time.Duration, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err != nil {
+		d = max(d, u.timeout)
+		u.failures++
+		u.consecutiveFailures++
+		u.lastError = err.Error()
+	} else {
+		u.successes++
+		u.consecutiveFailures = 0
+	}
+	if u.latency == 0 {
+		u.latency = d
+		return
+	}
+	u.latency += time.Duration(ewmaWeight * float64(d-u.latency))
+}
+
+// Latency is the moving average of the upstream's response times, zero before the first exchange
+func (u *Upstream) Latency() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.latency
+}
+
+// ConsecutiveFailures since the last successful exchange
+func (u *Upstream) ConsecutiveFailures() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.consecutiveFailures
+}
+
+// healthy upstreams failed less than maxFailures times in a row
+func (u *Upstream) healthy(maxFailures int) bool {
+	return u.ConsecutiveFailures() < maxFailures
+}
+
+// eachUpstream calls fn for the default upstreams and then for the upstreams of each forwarded zone
+func (n *Names) eachUpstream(fn func(zone string, u *Upstream)) {
+	for _, u := range n.dnsUpstreams {
+		fn("", u)
+	}
+	zones := make([]string, 0, len(n.forwards))
+	for zone := range n.forwards {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	for _, zone := range zones {
+		for _, u := range n.forwards[zone] {
+			fn(zone, u)
+		}
+	}
+}
+
+// UpstreamStatus returns the health of all upstreams
+func (n *Names) UpstreamStatus() []UpstreamStatus {
+	var status []UpstreamStatus
+	n.eachUpstream(func(zone string, u *Upstream) {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		status = append(status, UpstreamStatus{
+			Addr:                u.addr,
+			Zone:                zone,
+			Healthy:             u.consecutiveFailures < n.config.UpstreamMaxFailures,
+			Successes:           u.successes,
+			Failures:            u.failures,
+			ConsecutiveFailures: u.consecutiveFailures,
+			Latency:             u.latency,
+			LastError:           u.lastError,
+		})
+	})
+	return status
+}
+
+// healthyUpstreams returns the upstreams queries can be sent to.
+// If all upstreams are unhealthy they are all returned, trying beats failing right away.
+func (n *Names) healthyUpstreams(upstreams []*Upstream) []*Upstream {
+	healthy := make([]*Upstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		if u.healthy(n.config.UpstreamMaxFailures) {
+			healthy = append(healthy, u)
+		}
+	}
+	if len(healthy) == 0 {
+		return upstreams
+	}
+	return healthy
+}
+
+// probeUpstreams periodically queries unhealthy upstreams for the NS records of their zone,
+// or of the probe domain for default upstreams, until they answer again and are put back into rotation
+func (n *Names) probeUpstreams() {
+	ticker := time.NewTicker(n.config.UpstreamProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n.eachUpstream(func(zone string, u *Upstream) {
+			if u.healthy(n.config.UpstreamMaxFailures) {
+				return
+			}
+			domain := zone
+			if domain == "" {
+				domain = probeDomain
+			}
+			req := &fastdns.Message{}
+			req.SetRequestQuestion(domain, fastdns.TypeNS, fastdns.ClassINET)
+			if _, err := exchange(n.ctx, req, u); err != nil {
+				n.Log.Debug().Err(err).Str("resolver", u.addr).Str("zone", zone).Msg("upstream still unhealthy")
+				return
+			}
+			n.Log.Info().Str("resolver", u.addr).Str("zone", zone).Msg("upstream recovered")
+		})
+	}
+}
+
+// reportUpstreams periodically logs the status of every upstream
+func (n *Names) reportUpstreams() {
+	ticker := time.NewTicker(n.config.UpstreamStatusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n.logUpstreamStatus()
+	}
+}
+
+// logUpstreamStatus logs the status of every upstream
+func (n *Names) logUpstreamStatus() {
+	for _, status := range n.UpstreamStatus() {
+		n.Log.Info().
+			Str("resolver", status.Addr).
+			Str("zone", status.Zone).
+			Bool("healthy", status.Healthy).
+			Uint64("successes", status.Successes).
+			Uint64("failures", status.Failures).
+			Int("consecutive_failures", status.ConsecutiveFailures).
+			Dur("latency", status.Latency).
+			Str("last_error", status.LastError).
+			Msg("upstream status")
+	}
+}
@@ -0,0 +1,76 @@
+package names
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamHealth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broken, working := &fakeExchanger{fail: true}, &fakeExchanger{}
+	log := zerolog.Nop()
+	n := &Names{
+		ctx:          ctx,
+		Log:          &log,
+		dnsUpstreams: newFakeUpstreams(broken, working),
+		config:       &Config{UpstreamMaxFailures: 2, UpstreamProbeInterval: 10 * time.Millisecond},
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := resolveWith(t, sequentialStrategy{}, n.healthyUpstreams(n.dnsUpstreams))
+		require.NoError(t, err)
+	}
+	// the broken upstream is skipped once it failed twice in a row
+	require.Len(t, n.healthyUpstreams(n.dnsUpstreams), 1)
+	_, err := resolveWith(t, sequentialStrategy{}, n.healthyUpstreams(n.dnsUpstreams))
+	require.NoError(t, err)
+	require.Equal(t, int32(2), broken.calls.Load())
+
+	status := n.UpstreamStatus()
+	require.False(t, status[0].Healthy)
+	require.Equal(t, uint64(2), status[0].Failures)
+	require.Equal(t, "fake upstream failure", status[0].LastError)
+	require.True(t, status[1].Healthy)
+	require.Equal(t, uint64(3), status[1].Successes)
+
+	// with all upstreams unhealthy all are tried
+	working.fail = true
+	for i := 0; i < 2; i++ {
+		_, err = resolveWith(t, sequentialStrategy{}, n.healthyUpstreams(n.dnsUpstreams))
+		require.Error(t, err)
+	}
+	require.Len(t, n.healthyUpstreams(n.dnsUpstreams), 2)
+
+	// a successful probe puts an upstream back into rotation
+	working.fail = false
+	go n.probeUpstreams()
+	require.Eventually(t, func() bool {
+		return n.UpstreamStatus()[1].Healthy
+	}, time.Second, 10*time.Millisecond)
+	require.False(t, n.UpstreamStatus()[0].Healthy)
+}
+
+func TestUpstreamStatusLog(t *testing.T) {
+	var buf bytes.Buffer
+	log := zerolog.New(&buf)
+	broken := &fakeExchanger{fail: true}
+	n := &Names{
+		Log:          &log,
+		dnsUpstreams: newFakeUpstreams(broken),
+		config:       &Config{UpstreamMaxFailures: 1},
+	}
+	_, err := resolveWith(t, sequentialStrategy{}, n.dnsUpstreams)
+	require.Error(t, err)
+
+	n.logUpstreamStatus()
+	require.Contains(t, buf.String(), `"healthy":false`)
+	require.Contains(t, buf.String(), `"failures":1`)
+	require.Contains(t, buf.String(), `"last_error":"fake upstream failure"`)
+	require.Contains(t, buf.String(), `"message":"upstream status"`)
+}
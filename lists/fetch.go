@@ -0,0 +1,160 @@
+package lists
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultFetchTimeout = 60 * time.Second
+	defaultMaxSize      = 64 << 20
+	defaultCacheDir     = "lists-cache"
+)
+
+// DefaultFetcher is used by PopulateCache
+var DefaultFetcher = &Fetcher{}
+
+// Fetcher downloads list sources and keeps a copy of each on disk. A source is only
+// downloaded again if it changed, and the copy is used if the source can't be fetched.
+type Fetcher struct {
+	// Client defaults to a client with a 60s timeout
+	Client *http.Client
+	// Dir the copies are kept in, defaults to lists-cache
+	Dir string
+	// MaxSize of a source in bytes, defaults to 64MB
+	MaxSize int64
+	// Sources defined by the user, see Catalog
+	Sources map[string]SourceConfig
+}
+
+// cacheMeta is stored next to the copy of a source for conditional requests
+type cacheMeta struct {
+	// URL the copy was downloaded from, copies of other URLs are ignored
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+func (f *Fetcher) client() *http.Client {
+	if f.Client != nil {
+		return f.Client
+	}
+	return &http.Client{Timeout: defaultFetchTimeout}
+}
+
+func (f *Fetcher) dir() string {
+	if f.Dir != "" {
+		return f.Dir
+	}
+	return defaultCacheDir
+}
+
+func (f *Fetcher) maxSize() int64 {
+	if f.MaxSize > 0 {
+		return f.MaxSize
+	}
+	return defaultMaxSize
+}
+
+// fetch returns the path of the copy of source on disk, after downloading it if it changed.
+// If offline is set an existing copy is used as it is. Local sources are read in place.
+func (f *Fetcher) fetch(name string, source SourceConfig, offline bool, log *zerolog.Logger) (string, error) {
+	if local, ok := LocalPath(source.Url); ok {
+		return local, nil
+	}
+	path := filepath.Join(f.dir(), name+".txt")
+	if _, ok := cached(path, source.Url); ok && offline {
+		return path, nil
+	}
+	err := f.download(path, source.Url)
+	if err == nil {
+		return path, nil
+	}
+	if _, ok := cached(path, source.Url); !ok {
+		return "", fmt.Errorf("fetching %s: %w", name, err)
+	}
+	log.Warn().Err(err).Str("source", name).Msg("failed to fetch list, using the copy on disk")
+	return path, nil
+}
+
+// cached returns the metadata of the copy at path if there is one and it was downloaded from url
+func cached(path, url string) (cacheMeta, bool) {
+	var meta cacheMeta
+	if _, err := os.Stat(path); err != nil {
+		return meta, false
+	}
+	data, err := os.ReadFile(path + ".meta")
+	if err != nil || json.Unmarshal(data, &meta) != nil || meta.URL != url {
+		return cacheMeta{}, false
+	}
+	return meta, true
+}
+
+// download writes the content at url to path, unless the copy at path is still current
+func (f *Fetcher) download(path, url string) error {
+	meta, ok := cached(path, url)
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if meta.ETag != "" {
+		req.Header.Set("If-None-Match", meta.ETag)
+	}
+	if meta.LastModified != "" {
+		req.Header.Set("If-Modified-Since", meta.LastModified)
+	}
+	resp, err := f.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		if !ok {
+			return errors.New("not modified, but there is no copy on disk")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, io.LimitReader(resp.Body, f.maxSize()+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if n > f.maxSize() {
+		return fmt.Errorf("larger than %d bytes", f.maxSize())
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	meta = cacheMeta{URL: url, ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path+".meta", data, 0o644)
+}
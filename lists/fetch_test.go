@@ -0,0 +1,109 @@
+package lists
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetcher(t *testing.T) {
+	var requests, conditional atomic.Int32
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if code := int(status.Load()); code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("# comment\n0.0.0.0 ads.example.com\n0.0.0.0 tracker.example.net\n"))
+	}))
+	defer srv.Close()
+
+	log := zerolog.Nop()
+	f := &Fetcher{Dir: t.TempDir()}
+	sources := map[string]SourceConfig{
+		"test": {Url: srv.URL, Rule: `/^0\.0\.0\.0/ { print $2 }`},
+	}
+
+	list := NewList()
+	require.NoError(t, f.populate(list, sources, []string{"test"}, false, &log))
+	require.True(t, ContainsDomain(list.Trie, "ads.example.com"))
+	match, ok := list.MatchDomain("tracker.example.net")
+	require.True(t, ok)
+	// the line of the source, not of the output of the rule
+	require.Equal(t, []Origin{{Source: "test", Line: 3}}, match.Origins)
+
+	// unchanged sources are read from disk
+	list = NewList()
+	require.NoError(t, f.populate(list, sources, []string{"test"}, false, &log))
+	require.EqualValues(t, 1, conditional.Load())
+	require.True(t, ContainsDomain(list.Trie, "ads.example.com"))
+
+	// copies on disk are used as they are when offline
+	before := requests.Load()
+	list = NewList()
+	require.NoError(t, f.populate(list, sources, []string{"test"}, true, &log))
+	require.Equal(t, before, requests.Load())
+	require.True(t, ContainsDomain(list.Trie, "ads.example.com"))
+
+	// errors fall back to the copy on disk
+	status.Store(http.StatusInternalServerError)
+	list = NewList()
+	require.NoError(t, f.populate(list, sources, []string{"test"}, false, &log))
+	require.True(t, ContainsDomain(list.Trie, "ads.example.com"))
+
+	srv.Close()
+	list = NewList()
+	require.NoError(t, f.populate(list, sources, []string{"test"}, false, &log))
+	require.True(t, ContainsDomain(list.Trie, "ads.example.com"))
+
+	// copies of another URL aren't used, even when offline
+	moved := map[string]SourceConfig{"test": {Url: srv.URL + "/moved", Rule: sources["test"].Rule}}
+	require.Error(t, f.populate(NewList(), moved, []string{"test"}, true, &log))
+
+	// without a copy on disk errors are returned
+	f = &Fetcher{Dir: t.TempDir()}
+	require.Error(t, f.populate(NewList(), sources, []string{"test"}, false, &log))
+}
+
+func TestFetcherLimits(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		default:
+			w.Write([]byte(strings.Repeat("0.0.0.0 ads.example.com\n", 100)))
+		}
+	}))
+	defer srv.Close()
+
+	log := zerolog.Nop()
+	f := &Fetcher{Dir: t.TempDir(), MaxSize: 1024}
+	_, err := f.fetch("large", SourceConfig{Url: srv.URL + "/large"}, false, &log)
+	require.ErrorContains(t, err, "larger than 1024 bytes")
+	_, err = f.fetch("missing", SourceConfig{Url: srv.URL + "/missing"}, false, &log)
+	require.ErrorContains(t, err, "404")
+
+	entries, err := os.ReadDir(f.Dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	f.MaxSize = 0
+	path, err := f.fetch("large", SourceConfig{Url: srv.URL + "/large"}, false, &log)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(f.Dir, "large.txt"), path)
+}
@@ -0,0 +1,65 @@
+package lists
+
+import (
+	"github.com/glaslos/trie"
+)
+
+// Origin tells where an entry of a list comes from
+type Origin struct {
+	// Source is the name of the list source or the path of the list file
+	Source string `json:"source"`
+	// Line is the number of the line of the source the entry was read from
+	Line int `json:"line,omitempty"`
+}
+
+// Match is the entry of a list a name matched and the origins of that entry
+type Match struct {
+	Entry   string   `json:"entry"`
+	Origins []Origin `json:"origins"`
+}
+
+// List is a trie of reversed domains which remembers where its entries come from
+type List struct {
+	*trie.Trie
+	origins map[string][]Origin
+}
+
+// NewList returns an empty list
+func NewList() *List {
+	return &List{Trie: trie.NewTrie(), origins: map[string][]Origin{}}
+}
+
+// Add adds domain from origin to the list and reports whether it was new.
+// Each source is recorded once per domain.
+func (l *List) Add(domain string, origin Origin) bool {
+	domain = normalize(domain)
+	added := AddDomain(l.Trie, domain)
+	if !added && !l.Has(ReverseString(domain)) {
+		// not a valid entry
+		return false
+	}
+	for _, o := range l.origins[domain] {
+		if o.Source == origin.Source {
+			return added
+		}
+	}
+	l.origins[domain] = append(l.origins[domain], origin)
+	return added
+}
+
+// Match returns the entry matching name, see Contains
+func (l *List) Match(name string) (Match, bool) {
+	return l.lookup(match(l.Trie, name, false))
+}
+
+// MatchDomain returns the entry matching name, see ContainsDomain
+func (l *List) MatchDomain(name string) (Match, bool) {
+	return l.lookup(match(l.Trie, name, true))
+}
+
+func (l *List) lookup(entry string, ok bool) (Match, bool) {
+	if !ok {
+		return Match{}, false
+	}
+	return Match{Entry: entry, Origins: l.origins[entry]}, true
+}
@@ -4,9 +4,13 @@ import (
 	"bufio"
 	"bytes"
 	"embed"
+	"encoding/gob"
 	"encoding/json"
-	"net/http"
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/benhoyt/goawk/interp"
@@ -18,41 +22,136 @@ import (
 //go:embed sources.json
 var sources embed.FS
 
-type sourceConfig struct {
+// Sources are embedded or defined by the user
+const (
+	SourceEmbedded = "embedded"
+	SourceUser     = "user"
+)
+
+// SourceConfig describes where a list is fetched from and how its domains are extracted.
+// Sources without a rule are in one of the formats of ParseLine.
+type SourceConfig struct {
 	Url     string `json:"url,omitempty"`
 	Rule    string `json:"rule,omitempty"`
 	Size    string `json:"size,omitempty"`
 	Focus   string `json:"focus,omitempty"`
 	Descurl string `json:"descurl,omitempty"`
+	// From is SourceEmbedded or SourceUser
+	From string `json:"-" mapstructure:"-"`
 }
 
-func Dump(tree *trie.Trie) error {
-	return tree.DumpToFile("lists.dump")
+const (
+	dumpFile    = "lists.dump"
+	originsFile = "lists.origins"
+)
+
+// Dump writes list and the origins of its entries to disk
+func Dump(list *List) error {
+	if err := list.DumpToFile(dumpFile); err != nil {
+		return err
+	}
+	fh, err := os.Create(originsFile)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	return gob.NewEncoder(fh).Encode(list.origins)
 }
 
-func Load() (*trie.Trie, error) {
-	if _, err := os.Stat("lists.dump"); err == nil {
-		return trie.LoadFromFile("lists.dump")
+// Load reads the list written by Dump, entries of dumps without origins have none
+func Load() (*List, error) {
+	list := NewList()
+	if _, err := os.Stat(dumpFile); err != nil {
+		return list, nil
+	}
+	tree, err := trie.LoadFromFile(dumpFile)
+	if err != nil {
+		return nil, err
+	}
+	list.Trie = tree
+	fh, err := os.Open(originsFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return list, nil
 	}
-	return trie.NewTrie(), nil
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	if err := gob.NewDecoder(fh).Decode(&list.origins); err != nil {
+		return nil, err
+	}
+	return list, nil
 }
 
-func DecodeConfig() (map[string]sourceConfig, error) {
+// DecodeConfig returns the embedded sources
+func DecodeConfig() (map[string]SourceConfig, error) {
 	data, err := sources.Open("sources.json")
 	if err != nil {
 		return nil, err
 	}
 	dec := json.NewDecoder(data)
-	sourcesList := map[string]sourceConfig{}
-	err = dec.Decode(&sourcesList)
-	return sourcesList, err
+	sourcesList := map[string]SourceConfig{}
+	if err := dec.Decode(&sourcesList); err != nil {
+		return nil, err
+	}
+	for name, source := range sourcesList {
+		source.From = SourceEmbedded
+		sourcesList[name] = source
+	}
+	return sourcesList, nil
 }
 
-func PopulateCache(tree *trie.Trie, lists []string, log *zerolog.Logger) error {
+// Catalog returns the embedded sources merged with the user defined sources,
+// which replace embedded sources of the same name
+func Catalog(user map[string]SourceConfig) (map[string]SourceConfig, error) {
 	sourcesList, err := DecodeConfig()
+	if err != nil {
+		return nil, err
+	}
+	for name, source := range user {
+		if source.Url == "" {
+			return nil, fmt.Errorf("source %s has no url", name)
+		}
+		if source.Rule != "" {
+			if _, err := parser.ParseProgram([]byte(source.Rule), nil); err != nil {
+				return nil, fmt.Errorf("source %s has an invalid rule: %w", name, err)
+			}
+		}
+		source.From = SourceUser
+		sourcesList[name] = source
+	}
+	return sourcesList, nil
+}
+
+// lineRule runs before the rule of a source and makes every line it prints end with
+// the number of the input line, so entries can be traced back to the line of the source
+const lineRule = "{ ORS = \"\\t\" NR \"\\n\" }\n"
+
+// PopulateCache adds the domains of the named sources to list, fetched by DefaultFetcher
+func PopulateCache(list *List, lists []string, log *zerolog.Logger) error {
+	return DefaultFetcher.PopulateCache(list, lists, log)
+}
+
+// PopulateCache adds the domains of the named sources to list
+func (f *Fetcher) PopulateCache(list *List, lists []string, log *zerolog.Logger) error {
+	sourcesList, err := Catalog(f.Sources)
+	if err != nil {
+		return err
+	}
+	return f.populate(list, sourcesList, lists, false, log)
+}
+
+// PopulateFromDisk adds the domains of the named sources to list like PopulateCache, but reads
+// the copies on disk instead of fetching the sources again. Sources without a copy are fetched.
+func (f *Fetcher) PopulateFromDisk(list *List, lists []string, log *zerolog.Logger) error {
+	sourcesList, err := Catalog(f.Sources)
 	if err != nil {
 		return err
 	}
+	return f.populate(list, sourcesList, lists, true, log)
+}
+
+func (f *Fetcher) populate(list *List, sourcesList map[string]SourceConfig, lists []string, offline bool, log *zerolog.Logger) error {
 	for _, listName := range lists {
 		log.Debug().Str("source", listName).Msg("fetching list")
 		source, ok := sourcesList[listName]
@@ -60,20 +159,39 @@ func PopulateCache(tree *trie.Trie, lists []string, log *zerolog.Logger) error {
 			log.Debug().Str("source", listName).Msg("didn't find list")
 			continue
 		}
-		prog, err := parser.ParseProgram([]byte(source.Rule), nil)
+		path, err := f.fetch(listName, source, offline, log)
+		if err != nil {
+			return err
+		}
+		if source.Rule == "" {
+			// sources without a rule are in one of the formats of ParseLine
+			fh, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			count, err := load(list, fh, listName)
+			fh.Close()
+			if err != nil {
+				return err
+			}
+			log.Debug().Str("source", listName).Msgf("added %d new domains", count)
+			continue
+		}
+		prog, err := parser.ParseProgram([]byte(lineRule+source.Rule), nil)
 		if err != nil {
 			return err
 		}
-		resp, err := http.Get(source.Url)
+		fh, err := os.Open(path)
 		if err != nil {
 			return err
 		}
 		var buf bytes.Buffer
 		config := &interp.Config{
-			Stdin:  resp.Body,
+			Stdin:  fh,
 			Output: &buf,
 		}
 		_, err = interp.ExecProgram(prog, config)
+		fh.Close()
 		if err != nil {
 			return err
 		}
@@ -81,19 +199,16 @@ func PopulateCache(tree *trie.Trie, lists []string, log *zerolog.Logger) error {
 		var count = 0
 		scanner := bufio.NewScanner(&buf)
 		for scanner.Scan() {
-			line := scanner.Text()
-			if scanner.Err() != nil {
-				log.Err(err).Msg("failed to read line")
-				break
-			}
-			line = strings.Trim(line, " \n")
-			line = ReverseString(strings.Trim(line, "."))
-			if !tree.Has(line) {
-				tree.Add(line)
+			domain, nr, _ := strings.Cut(scanner.Text(), "\t")
+			lineNo, _ := strconv.Atoi(nr)
+			if list.Add(domain, Origin{Source: listName, Line: lineNo}) {
 				count++
 			}
 		}
-		log.Debug().Str("source", listName).Msgf("added %d new block domains", count)
+		if err := scanner.Err(); err != nil {
+			log.Err(err).Str("source", listName).Msg("failed to read line")
+		}
+		log.Debug().Str("source", listName).Msgf("added %d new domains", count)
 	}
 	return nil
 }
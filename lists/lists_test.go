@@ -1,6 +1,8 @@
 package lists
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/glaslos/trie"
@@ -20,8 +22,35 @@ func TestContaints(t *testing.T) {
 
 func TestPrefix(t *testing.T) {
 	tree := trie.NewTrie()
-	tree.Add(ReverseString("*.google.com"))
-	require.True(t, len(tree.PrefixMembers(ReverseString("google.com"))) >= 0)
+	AddDomain(tree, "*.google.com")
+	require.True(t, ContainsDomain(tree, "mail.google.com"))
+	require.True(t, ContainsDomain(tree, "a.b.google.com"))
+	require.False(t, ContainsDomain(tree, "google.com"))
+	require.False(t, ContainsDomain(tree, "notgoogle.com"))
+}
+
+func TestContainsDomain(t *testing.T) {
+	tree := trie.NewTrie()
+	AddDomain(tree, "doubleclick.net")
+	AddDomain(tree, "ads.example.com")
+
+	for name, contains := range map[string]bool{
+		"doubleclick.net":            true,
+		"ad.doubleclick.net":         true,
+		"a.b.c.doubleclick.net.":     true,
+		"AD.DoubleClick.net":         true,
+		"notdoubleclick.net":         false,
+		"ad.notdoubleclick.net":      false,
+		"doubleclick.net.example":    false,
+		"net":                        false,
+		"ads.example.com":            true,
+		"x.ads.example.com":          true,
+		"example.com":                false,
+		"www.example.com":            false,
+		"ads.example.com.evil.local": false,
+	} {
+		require.Equal(t, contains, ContainsDomain(tree, name), name)
+	}
 }
 
 func BenchmarkTrieHas(b *testing.B) {
@@ -43,3 +72,100 @@ func BenchmarkTriePrefix(b *testing.B) {
 		}
 	}
 }
+
+func TestContainsWildcard(t *testing.T) {
+	tree := trie.NewTrie()
+	require.True(t, AddDomain(tree, "Example.com."))
+	require.False(t, AddDomain(tree, "example.com"))
+	require.True(t, AddDomain(tree, "*.example.net"))
+
+	for name, contains := range map[string]bool{
+		"example.com":         true,
+		"EXAMPLE.com.":        true,
+		"www.example.com":     false,
+		"www.example.net":     true,
+		"a.b.example.net":     true,
+		"example.net":         false,
+		"notexample.net":      false,
+		"www.notexample.net":  false,
+		"example.net.example": false,
+	} {
+		require.Equal(t, contains, Contains(tree, name), name)
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allow.txt")
+	require.NoError(t, os.WriteFile(path, []byte("# comment\nexample.com\n\n  *.example.net  \nexample.com\n"), 0o600))
+	list := NewList()
+	count, err := LoadFile(list, path)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	match, ok := list.Match("www.example.net")
+	require.True(t, ok)
+	require.Equal(t, Match{Entry: "*.example.net", Origins: []Origin{{Source: path, Line: 4}}}, match)
+
+	_, err = LoadFile(list, filepath.Join(t.TempDir(), "missing.txt"))
+	require.Error(t, err)
+}
+
+func TestListOrigins(t *testing.T) {
+	list := NewList()
+	require.True(t, list.Add("doubleclick.net", Origin{Source: "adguard", Line: 3}))
+	require.False(t, list.Add("DoubleClick.net", Origin{Source: "adaway", Line: 7}))
+	require.False(t, list.Add("doubleclick.net", Origin{Source: "adaway", Line: 9}))
+	require.True(t, list.Add("ads.doubleclick.net", Origin{Source: "adaway", Line: 8}))
+	require.False(t, list.Add("", Origin{Source: "adaway", Line: 10}))
+
+	match, ok := list.MatchDomain("x.doubleclick.net")
+	require.True(t, ok)
+	require.Equal(t, "doubleclick.net", match.Entry)
+	require.Equal(t, []Origin{{Source: "adguard", Line: 3}, {Source: "adaway", Line: 7}}, match.Origins)
+
+	// the most specific entry wins
+	match, ok = list.MatchDomain("x.ads.doubleclick.net")
+	require.True(t, ok)
+	require.Equal(t, "ads.doubleclick.net", match.Entry)
+
+	_, ok = list.Match("x.doubleclick.net")
+	require.False(t, ok)
+}
+
+func TestDumpAndLoad(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	list := NewList()
+	list.Add("doubleclick.net", Origin{Source: "adguard", Line: 3})
+	require.NoError(t, Dump(list))
+
+	list, err = Load()
+	require.NoError(t, err)
+	match, ok := list.MatchDomain("ad.doubleclick.net")
+	require.True(t, ok)
+	require.Equal(t, []Origin{{Source: "adguard", Line: 3}}, match.Origins)
+}
+
+func TestCatalog(t *testing.T) {
+	embedded, err := DecodeConfig()
+	require.NoError(t, err)
+	require.Equal(t, SourceEmbedded, embedded["adguard"].From)
+
+	catalog, err := Catalog(map[string]SourceConfig{
+		"internal": {Url: "file:///etc/names/hosts", Focus: "internal"},
+		"adguard":  {Url: "https://example.com/filter.txt", Rule: "{ print $1 }"},
+	})
+	require.NoError(t, err)
+	require.Len(t, catalog, len(embedded)+1)
+	require.Equal(t, SourceConfig{Url: "file:///etc/names/hosts", Focus: "internal", From: SourceUser}, catalog["internal"])
+	require.Equal(t, "https://example.com/filter.txt", catalog["adguard"].Url)
+	require.Equal(t, SourceUser, catalog["adguard"].From)
+	require.Equal(t, embedded["adaway"], catalog["adaway"])
+
+	_, err = Catalog(map[string]SourceConfig{"missing": {Rule: "{ print $1 }"}})
+	require.ErrorContains(t, err, "no url")
+	_, err = Catalog(map[string]SourceConfig{"invalid": {Url: "file:///etc/hosts", Rule: "{ print $1"}})
+	require.ErrorContains(t, err, "invalid rule")
+}
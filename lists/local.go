@@ -0,0 +1,144 @@
+package lists
+
+import (
+	"bufio"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const fileScheme = "file://"
+
+// LocalPath returns the path of a file:// source and whether source is one
+func LocalPath(source string) (string, bool) {
+	if !strings.HasPrefix(source, fileScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(source, fileScheme), true
+}
+
+// cosmeticMarkers separate the domain of an adblock rule from the elements it hides or exempts
+var cosmeticMarkers = []string{"##", "#@#", "#?#", "#$#"}
+
+// ParseLine returns the domains of a line in hosts format, a plain domain or an
+// adblock rule like ||example.com^. Comments, exceptions and rules which don't
+// block a whole domain are skipped.
+func ParseLine(line string) []string {
+	for _, marker := range cosmeticMarkers {
+		if strings.Contains(line, marker) {
+			return nil
+		}
+	}
+	// # starts a comment at the start of a line or after whitespace
+	for i := 0; i < len(line); i++ {
+		if line[i] == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			line = line[:i]
+			break
+		}
+	}
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '!' || line[0] == '[' {
+		return nil
+	}
+	if strings.HasPrefix(line, "||") {
+		domain, ok := strings.CutSuffix(line[2:], "^")
+		if !ok || !validDomain(domain) {
+			return nil
+		}
+		return []string{domain}
+	}
+	fields := strings.Fields(line)
+	if len(fields) > 1 {
+		// hosts format, an address followed by one or more names
+		if _, err := netip.ParseAddr(fields[0]); err != nil {
+			return nil
+		}
+		fields = fields[1:]
+	}
+	var domains []string
+	for _, domain := range fields {
+		if validDomain(domain) {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// validDomain reports whether domain looks like a domain, optionally starting with *.
+func validDomain(domain string) bool {
+	domain = strings.TrimPrefix(domain, wildcard)
+	if domain == "" || !strings.Contains(domain, ".") || normalize(domain) == "localhost" {
+		return false
+	}
+	if _, err := netip.ParseAddr(domain); err == nil {
+		return false
+	}
+	for _, r := range domain {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// LoadFile adds the domains in the file at path to list, see ParseLine for the formats.
+// The path may be given as a file:// URL.
+func LoadFile(list *List, path string) (int, error) {
+	if local, ok := LocalPath(path); ok {
+		path = local
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return load(list, f, path)
+}
+
+// LoadPath adds the domains in the file at path, or in all files in the directory at path, to list
+func LoadPath(list *List, path string) (int, error) {
+	if local, ok := LocalPath(path); ok {
+		path = local
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if !info.IsDir() {
+		return LoadFile(list, path)
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		n, err := LoadFile(list, filepath.Join(path, entry.Name()))
+		if err != nil {
+			return count, err
+		}
+		count += n
+	}
+	return count, nil
+}
+
+func load(list *List, r io.Reader, source string) (int, error) {
+	var count, lineNo = 0, 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNo++
+		for _, domain := range ParseLine(scanner.Text()) {
+			if list.Add(domain, Origin{Source: source, Line: lineNo}) {
+				count++
+			}
+		}
+	}
+	return count, scanner.Err()
+}
@@ -0,0 +1,116 @@
+package lists
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLine(t *testing.T) {
+	for line, domains := range map[string][]string{
+		"example.com":                         {"example.com"},
+		"  *.example.com  ":                   {"*.example.com"},
+		"0.0.0.0 ads.example.com":             {"ads.example.com"},
+		"127.0.0.1\tads.example.com # ads":    {"ads.example.com"},
+		":: ads.example.com":                  {"ads.example.com"},
+		"||ads.example.com^":                  {"ads.example.com"},
+		"0.0.0.0 a.example.com b.example.com": {"a.example.com", "b.example.com"},
+		"127.0.0.1 localhost ads.example.com": {"ads.example.com"},
+		"# comment":                           nil,
+		"! adblock comment":                   nil,
+		"[Adblock Plus 2.0]":                  nil,
+		"@@||ads.example.com^":                nil,
+		"||ads.example.com^$third-party":      nil,
+		"||ads.example.com/banner^":           nil,
+		"127.0.0.1 localhost":                 nil,
+		"localhost":                           nil,
+		"a.example.com b.example.com":         nil,
+		"example.com/path":                    nil,
+		"example.com##.ad-banner":             nil,
+		"example.com#?#div:has(.ad)":          nil,
+		"news.example.org#@#.sponsor":         nil,
+		"example.com#$#.ad { display: none }": nil,
+		"0.0.0.0 0.0.0.0":                     nil,
+		"0.0.0.0 192.0.2.1 ads.example.com":   {"ads.example.com"},
+		"0.0.0.0 ads.example.com#ads":         nil,
+		"ads.example.com\t# ads":              {"ads.example.com"},
+	} {
+		require.Equal(t, domains, ParseLine(line), line)
+	}
+}
+
+func TestLoadPath(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "hosts"), []byte("0.0.0.0 ads.example.com\n0.0.0.0 a.example.org b.example.org\n"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "adblock.txt"), []byte("! comment\n||tracker.example.net^\n"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".hidden"), []byte("hidden.example.org\n"), 0o600))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0o700))
+
+	list := NewList()
+	count, err := LoadPath(list, "file://"+dir)
+	require.NoError(t, err)
+	require.Equal(t, 4, count)
+	require.True(t, ContainsDomain(list.Trie, "ads.example.com"))
+	match, ok := list.MatchDomain("b.example.org")
+	require.True(t, ok)
+	require.Equal(t, []Origin{{Source: filepath.Join(dir, "hosts"), Line: 2}}, match.Origins)
+	match, ok = list.MatchDomain("x.tracker.example.net")
+	require.True(t, ok)
+	require.Equal(t, []Origin{{Source: filepath.Join(dir, "adblock.txt"), Line: 2}}, match.Origins)
+	require.False(t, ContainsDomain(list.Trie, "hidden.example.org"))
+
+	_, err = LoadPath(list, filepath.Join(dir, "missing"))
+	require.Error(t, err)
+}
+
+func TestLocalSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	require.NoError(t, os.WriteFile(path, []byte("0.0.0.0 ads.example.com\n0.0.0.0 tracker.example.net\n"), 0o600))
+
+	log := zerolog.Nop()
+	f := &Fetcher{Dir: t.TempDir()}
+	list := NewList()
+	require.NoError(t, f.populate(list, map[string]SourceConfig{
+		"rule":    {Url: "file://" + path, Rule: `/tracker/ { print $2 }`},
+		"formats": {Url: "file://" + path},
+	}, []string{"rule", "formats"}, false, &log))
+	match, ok := list.MatchDomain("tracker.example.net")
+	require.True(t, ok)
+	require.Equal(t, []Origin{{Source: "rule", Line: 2}, {Source: "formats", Line: 2}}, match.Origins)
+	require.True(t, ContainsDomain(list.Trie, "ads.example.com"))
+
+	// local sources aren't copied
+	entries, err := os.ReadDir(f.Dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(t.TempDir(), "hosts")
+	require.NoError(t, os.WriteFile(file, []byte("ads.example.com\n"), 0o600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan struct{}, 10)
+	watcher, err := NewWatcher([]string{dir, "file://" + file})
+	require.NoError(t, err)
+	go watcher.Run(ctx, func() { changed <- struct{}{} })
+
+	for _, path := range []string{filepath.Join(dir, "new"), file} {
+		require.NoError(t, os.WriteFile(path, []byte("tracker.example.net\n"), 0o600))
+		select {
+		case <-changed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no change reported for %s", path)
+		}
+	}
+
+	_, err = NewWatcher([]string{filepath.Join(dir, "missing")})
+	require.Error(t, err)
+}
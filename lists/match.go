@@ -0,0 +1,65 @@
+package lists
+
+import (
+	"strings"
+
+	"github.com/glaslos/trie"
+)
+
+// wildcard prefixes entries which match all subdomains of a domain
+const wildcard = "*."
+
+// normalize lowercases domain and strips surrounding whitespace and dots
+func normalize(domain string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(domain), "."))
+}
+
+// AddDomain adds domain to tree in reverse and reports whether it was new.
+// Domains starting with *. match all subdomains of the domain, see Contains and ContainsDomain.
+func AddDomain(tree *trie.Trie, domain string) bool {
+	domain = normalize(domain)
+	if domain == "" || domain == "*" {
+		return false
+	}
+	entry := ReverseString(domain)
+	if tree.Has(entry) {
+		return false
+	}
+	tree.Add(entry)
+	return true
+}
+
+// Contains reports whether tree has an entry for name itself,
+// or a wildcard entry for one of the domains name is a subdomain of
+func Contains(tree *trie.Trie, name string) bool {
+	_, ok := match(tree, name, false)
+	return ok
+}
+
+// ContainsDomain reports whether tree has an entry for name or one of the domains
+// name is a subdomain of, or a wildcard entry for one of those domains.
+// Domains only match at label boundaries, example.com doesn't match notexample.com.
+func ContainsDomain(tree *trie.Trie, name string) bool {
+	_, ok := match(tree, name, true)
+	return ok
+}
+
+// match returns the entry of tree name matches, the most specific one if there are several
+func match(tree *trie.Trie, name string, parents bool) (string, bool) {
+	name = normalize(name)
+	reversed := ReverseString(name)
+	if name != "" && tree.Has(reversed) {
+		return name, true
+	}
+	// each dot in the reversed name ends a parent domain, the longest comes first
+	for i := strings.LastIndexByte(reversed, '.'); i >= 0; i = strings.LastIndexByte(reversed[:i], '.') {
+		parent := reversed[:i]
+		if parents && tree.Has(parent) {
+			return ReverseString(parent), true
+		}
+		if tree.Has(parent + ReverseString(wildcard)) {
+			return wildcard + ReverseString(parent), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,85 @@
+package lists
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDelay collects the events of a change written in several steps
+const watchDelay = 500 * time.Millisecond
+
+// Watcher reports changes of files and of the files in directories
+type Watcher struct {
+	watcher *fsnotify.Watcher
+	dirs    map[string]bool
+	files   map[string]bool
+}
+
+// NewWatcher watches the files at paths and the files in the directories at paths.
+// Files are watched through their directory, so files replaced by editors keep being watched.
+func NewWatcher(paths []string) (*Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	dirs := map[string]bool{}
+	files := map[string]bool{}
+	for _, path := range paths {
+		if local, ok := LocalPath(path); ok {
+			path = local
+		}
+		if path, err = filepath.Abs(path); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			watcher.Close()
+			return nil, err
+		}
+		dir := path
+		if info.IsDir() {
+			dirs[path] = true
+		} else {
+			dir = filepath.Dir(path)
+			files[path] = true
+		}
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+	return &Watcher{watcher: watcher, dirs: dirs, files: files}, nil
+}
+
+// Run calls fn whenever a watched file changes until ctx is done, then it closes w
+func (w *Watcher) Run(ctx context.Context, fn func()) {
+	defer w.watcher.Close()
+	timer := time.NewTimer(watchDelay)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Chmod) || !(w.files[event.Name] || w.dirs[filepath.Dir(event.Name)]) {
+				continue
+			}
+			timer.Reset(watchDelay)
+		case _, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+		case <-timer.C:
+			fn()
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package names
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/phuslu/fastdns"
+)
+
+const (
+	sectionAnswer = iota
+	sectionAuthority
+	sectionAdditional
+)
+
+var errMalformedMsg = errors.New("malformed dns message")
+
+// record locates a resource record inside a raw DNS message
+type record struct {
+	section int
+	// start is the offset of the owner name
+	start int
+	// hdr is the offset of the type, class, TTL and rdata length fields
+	hdr int
+	// end is the offset right after the rdata
+	end int
+	typ uint16
+}
+
+// skipName returns the offset right after the domain name starting at off
+func skipName(raw []byte, off int) (int, bool) {
+	for off < len(raw) {
+		switch b := raw[off]; {
+		case b == 0:
+			return off + 1, true
+		case b&0xC0 == 0xC0:
+			// compression pointer ends the name
+			return off + 2, off+2 <= len(raw)
+		default:
+			off += int(b) + 1
+		}
+	}
+	return off, false
+}
+
+// walkRecords calls fn for each resource record in raw until fn returns false
+func walkRecords(raw []byte, fn func(rr record) bool) error {
+	if len(raw) < 12 {
+		return errMalformedMsg
+	}
+	off := 12
+	for i := 0; i < int(binary.BigEndian.Uint16(raw[4:])); i++ {
+		var ok bool
+		if off, ok = skipName(raw, off); !ok || off+4 > len(raw) {
+			return errMalformedMsg
+		}
+		off += 4
+	}
+	counts := []uint16{
+		binary.BigEndian.Uint16(raw[6:]),
+		binary.BigEndian.Uint16(raw[8:]),
+		binary.BigEndian.Uint16(raw[10:]),
+	}
+	for section, count := range counts {
+		for i := 0; i < int(count); i++ {
+			rr := record{section: section, start: off}
+			var ok bool
+			if rr.hdr, ok = skipName(raw, off); !ok || rr.hdr+10 > len(raw) {
+				return errMalformedMsg
+			}
+			rr.typ = binary.BigEndian.Uint16(raw[rr.hdr:])
+			rr.end = rr.hdr + 10 + int(binary.BigEndian.Uint16(raw[rr.hdr+8:]))
+			if rr.end > len(raw) {
+				return errMalformedMsg
+			}
+			if !fn(rr) {
+				return nil
+			}
+			off = rr.end
+		}
+	}
+	return nil
+}
+
+// answerFor returns a copy of the response raw addressed to the client that sent req
+func answerFor(raw []byte, req *fastdns.Message) []byte {
+	resp := append([]byte(nil), raw...)
+	binary.BigEndian.PutUint16(resp, req.Header.ID)
+	// echo the question in the casing the client used
+	if name := req.Question.Name; len(resp) >= 12+len(name) && bytes.EqualFold(resp[12:12+len(name)], name) {
+		copy(resp[12:], name)
+	}
+	return resp
+}
+
+// minTTL returns the lowest TTL of the answer and authority records in raw, zero if there are none.
+// Records with a TTL of zero are cached for a second to absorb bursts of identical queries.
+func minTTL(raw []byte) time.Duration {
+	var ttl uint32
+	var found bool
+	_ = walkRecords(raw, func(rr record) bool {
+		if rr.section == sectionAdditional {
+			return false
+		}
+		if v := binary.BigEndian.Uint32(raw[rr.hdr+4:]); !found || v < ttl {
+			ttl, found = v, true
+		}
+		return true
+	})
+	if found && ttl == 0 {
+		ttl = 1
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// ageTTLs rewrites the TTLs of the records in raw to their clamped value minus age,
+// so clients see the remaining lifetime of an answer served from the cache
+func ageTTLs(raw []byte, age time.Duration, clamp func(ttl time.Duration) time.Duration) {
+	_ = walkRecords(raw, func(rr record) bool {
+		if rr.typ == dns.TypeOPT {
+			// the TTL field of OPT records holds flags
+			return true
+		}
+		ttl := time.Duration(binary.BigEndian.Uint32(raw[rr.hdr+4:])) * time.Second
+		ttl = max(0, clamp(ttl)-age)
+		binary.BigEndian.PutUint32(raw[rr.hdr+4:], uint32(ttl/time.Second))
+		return true
+	})
+}
+
+// negativeTTL returns how long the NXDOMAIN or NODATA response raw may be cached per RFC 2308,
+// the lower of the TTL of the SOA record in the authority section and its MINIMUM field.
+// The SOA record TTL is lowered to that value so it ages correctly in the cache.
+// ok is false if there is no SOA record, such responses should not be cached.
+func negativeTTL(raw []byte) (ttl time.Duration, ok bool) {
+	_ = walkRecords(raw, func(rr record) bool {
+		if rr.section != sectionAuthority || rr.typ != dns.TypeSOA {
+			return rr.section <= sectionAuthority
+		}
+		// MINIMUM is the last field of the SOA rdata
+		if rr.end-4 < rr.hdr+10 {
+			return false
+		}
+		soaTTL := binary.BigEndian.Uint32(raw[rr.hdr+4:])
+		minimum := binary.BigEndian.Uint32(raw[rr.end-4:])
+		v := min(soaTTL, minimum)
+		binary.BigEndian.PutUint32(raw[rr.hdr+4:], v)
+		ttl, ok = time.Duration(v)*time.Second, true
+		return false
+	})
+	return ttl, ok
+}
+
+// isNegative reports whether resp is a NXDOMAIN or NODATA response
+func isNegative(resp *fastdns.Message) bool {
+	switch resp.Header.Flags.Rcode() {
+	case fastdns.RcodeNXDomain:
+		return true
+	case fastdns.RcodeNoError:
+		return resp.Header.ANCount == 0
+	}
+	return false
+}
+
+// errorResponse builds a response carrying rcode to the query buf. The ID, opcode and RD bit
+// are kept and the question is echoed if it can be parsed. It returns nil for queries too
+// short to carry a header, those can't be answered.
+func errorResponse(buf []byte, rcode fastdns.Rcode) []byte {
+	if len(buf) < 12 {
+		return nil
+	}
+	resp := make([]byte, 12, len(buf))
+	copy(resp, buf[:4])
+	// QR and RA set, opcode and RD kept, everything else cleared
+	resp[2] = 0x80 | buf[2]&0x79
+	resp[3] = 0x80 | byte(rcode)&0x0F
+	if binary.BigEndian.Uint16(buf[4:]) == 1 {
+		if end, ok := skipName(buf, 12); ok && end+4 <= len(buf) {
+			resp = append(resp, buf[12:end+4]...)
+			resp[5] = 1
+		}
+	}
+	return resp
+}
@@ -0,0 +1,58 @@
+package names
+
+import (
+	"testing"
+	"time"
+
+	"github.com/glaslos/names/cache"
+
+	"github.com/miekg/dns"
+	"github.com/phuslu/fastdns"
+	"github.com/stretchr/testify/require"
+)
+
+func packMsg(t *testing.T, msg *dns.Msg, records ...string) []byte {
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		require.NoError(t, err)
+		msg.Answer = append(msg.Answer, rr)
+	}
+	buf, err := msg.Pack()
+	require.NoError(t, err)
+	return buf
+}
+
+func TestMinTTL(t *testing.T) {
+	msg := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	require.Equal(t, time.Duration(0), minTTL(packMsg(t, msg)))
+
+	msg = new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	buf := packMsg(t, msg.SetEdns0(4096, false), "example.com. 300 IN A 192.0.2.1", "example.com. 60 IN A 192.0.2.2")
+	require.Equal(t, time.Minute, minTTL(buf))
+}
+
+func TestAgeTTLs(t *testing.T) {
+	msg := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	buf := packMsg(t, msg.SetEdns0(4096, true), "example.com. 300 IN A 192.0.2.1", "example.com. 5 IN A 192.0.2.2")
+	config := &cache.Config{MaxTTL: 200 * time.Second}
+	ageTTLs(buf, 10*time.Second, config.ClampTTL)
+
+	require.NoError(t, msg.Unpack(buf))
+	require.Equal(t, uint32(190), msg.Answer[0].Header().Ttl)
+	require.Equal(t, uint32(0), msg.Answer[1].Header().Ttl)
+	// OPT flags are left alone
+	require.True(t, msg.IsEdns0().Do())
+}
+
+func TestErrorResponse(t *testing.T) {
+	require.Nil(t, errorResponse([]byte{1, 2, 3}, fastdns.RcodeFormErr))
+
+	msg := new(dns.Msg).SetQuestion("example.com.", dns.TypeMX)
+	buf, err := msg.Pack()
+	require.NoError(t, err)
+	// a cut off question is not echoed
+	resp := new(dns.Msg)
+	require.NoError(t, resp.Unpack(errorResponse(buf[:20], fastdns.RcodeFormErr)))
+	require.Equal(t, dns.RcodeFormatError, resp.Rcode)
+	require.Empty(t, resp.Question)
+}
@@ -5,18 +5,20 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"net/netip"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/glaslos/names/cache"
 	"github.com/glaslos/names/lists"
 
-	"github.com/glaslos/trie"
+	"github.com/miekg/dns"
 	"github.com/phuslu/fastdns"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
@@ -26,9 +28,19 @@ import (
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
+// Upstream resolver names forwards queries to
 type Upstream struct {
-	addr   string
-	client *fastdns.Client
+	addr    string
+	client  exchanger
+	weight  int
+	timeout time.Duration
+
+	mu                  sync.Mutex
+	latency             time.Duration
+	successes           uint64
+	failures            uint64
+	consecutiveFailures int
+	lastError           string
 }
 
 // Names main struct
@@ -36,19 +48,62 @@ type Names struct {
 	ctx          context.Context
 	cache        *cache.Cache
 	dnsUpstreams []*Upstream
-	tree         *trie.Trie
-	Log          *zerolog.Logger
-	PC           net.PacketConn
-	Done         chan bool
+	// forwards maps zones to the upstreams queries for them are sent to
+	forwards  map[string][]*Upstream
+	bootstrap *bootstrap
+	strategy  strategy
+	// tree is the blocklist, it is swapped for a new one when the lists are refreshed
+	tree atomic.Pointer[lists.List]
+	// wg tracks the background goroutines, they return once ctx is done
+	wg sync.WaitGroup
+	// listsMu serializes updates of the lists
+	listsMu sync.Mutex
+	// allow holds the domains which are never blocked, it is swapped together with tree
+	allow atomic.Pointer[lists.List]
+	// block answers queries for blocked names
+	block *blocker
+	// fetcher fetches the blocklist and allowlist sources
+	fetcher     *lists.Fetcher
+	Log         *zerolog.Logger
+	PC          net.PacketConn
+	TCP         net.Listener
+	DoH         *http.Server
+	DoT         net.Listener
+	Done        chan bool
+	config      *Config
+	dohListener net.Listener
+	flights     flightGroup
 }
 
 // Config for names
 type Config struct {
-	ListenerAddress  string
-	CacheConfig      *cache.Config
-	LoggerConfig     *LoggerConfig
-	DNSClientNet     string
+	ListenerAddress string
+	CacheConfig     *cache.Config
+	LoggerConfig    *LoggerConfig
+	// DNSClientNet is the transport of upstreams without scheme: udp, tcp or tcp-tls
+	DNSClientNet string
+	// DNSClientTimeout limits how long to wait for upstreams without their own timeout
 	DNSClientTimeout time.Duration
+	// BootstrapResolvers resolve the hostnames of upstreams, they have to be given by IP address
+	BootstrapResolvers []string
+	// BootstrapInterval is how often the hostnames of upstreams are resolved again
+	BootstrapInterval time.Duration
+	// ResolveTimeout limits how long to wait for all upstreams of a query together
+	ResolveTimeout   time.Duration
+	TCPIdleTimeout   time.Duration
+	UpstreamStrategy string
+	// UpstreamMaxFailures in a row take an upstream out of rotation until a probe succeeds
+	UpstreamMaxFailures   int
+	UpstreamProbeInterval time.Duration
+	// UpstreamStatusInterval is how often the status of the upstreams is logged, never if zero
+	UpstreamStatusInterval time.Duration
+	// BlocklistRefreshInterval is how often the blocklists are fetched again, never if zero
+	BlocklistRefreshInterval time.Duration
+	// Sources are user defined list sources, they replace embedded sources of the same name
+	Sources     map[string]lists.SourceConfig
+	BlockConfig *BlockConfig
+	DoHConfig   *DoHConfig
+	DoTConfig   *DoTConfig
 }
 
 // LoggerConfig for creating the logger
@@ -58,11 +113,30 @@ type LoggerConfig struct {
 	MaxBackups int
 	MaxAge     int
 	Compress   bool
+	// Queries are logged with their result if set
+	Queries bool
+}
+
+// blockResolver is the resolver of block responses cached by earlier versions, block responses
+// aren't cached anymore so removing a name from the lists takes effect at once
+const blockResolver = "blocklist"
+
+// refreshAhead is the fraction of its TTL, as a divisor, before an answer expires in which
+// a cache hit refreshes it
+const refreshAhead = 10
+
+// queryLog starts the query log entry for key, which is discarded if query logging is off
+func (n *Names) queryLog(key cache.Key, result string) *zerolog.Event {
+	if !n.config.LoggerConfig.Queries {
+		return nil
+	}
+	return n.Log.Info().Str("name", key.Name).Str("type", dns.TypeToString[key.Type]).Str("result", result)
 }
 
 // serve responses to DNS requests
 func (n *Names) serve() {
 	n.Log.Print("PID: ", os.Getpid())
+	buf := make([]byte, dns.MaxMsgSize)
 L:
 	for {
 		n.PC.SetDeadline(time.Now().Add(time.Duration(1) * time.Second))
@@ -70,8 +144,6 @@ L:
 		case <-n.Done:
 			break L
 		default:
-			// read the query, shouldn't be more than 1024 bytes :grimace:
-			buf := make([]byte, 1024)
 			i, addr, err := n.PC.ReadFrom(buf)
 			if err != nil {
 				if e, ok := err.(net.Error); ok && e.Timeout() {
@@ -80,8 +152,9 @@ L:
 				n.Log.Print(err)
 				break L
 			}
+			query := append([]byte(nil), buf[:i]...)
 			go func() {
-				if err := n.handleUDP(buf[:i], n.PC, addr); err != nil {
+				if err := n.handleUDP(query, n.PC, addr); err != nil {
 					n.Log.Error().Err(err).Msg("failed to handle request")
 				}
 			}()
@@ -102,26 +175,25 @@ func makeLogger(config *LoggerConfig) *zerolog.Logger {
 	wr := diode.NewWriter(multi, 1000, 10*time.Millisecond, func(missed int) {
 		fmt.Printf("logger dropped %d messages", missed)
 	})
-	log.Logger = log.Output(wr)
-	return &log.Logger
+	// every instance gets its own logger instead of replacing the global one other instances use
+	logger := log.Output(wr)
+	return &logger
 }
 
 func (n *Names) dummyRefreshCacheFunc(cache *cache.Cache) {}
 
+// refreshCacheFunc refreshes the cached answers which would expire before it runs again
 func (n *Names) refreshCacheFunc(cache *cache.Cache) {
-	for domain, element := range cache.Elements {
-		req := fastdns.AcquireMessage()
-		defer fastdns.ReleaseMessage(req)
-		if err := fastdns.ParseMessage(req, element.Request, true); err != nil {
-			n.Log.Debug().Err(err)
-			return
+	for key, element := range cache.Live() {
+		if !expiresWithin(cache, &element, n.config.CacheConfig.RefreshInterval) {
+			continue
 		}
-		resp, err := n.resolveUpstream(req)
-		if err != nil {
-			n.Log.Debug().Err(err)
-			return
+		if element.Resolver == blockResolver || n.LookupLists(key.Name).Blocked {
+			continue
+		}
+		if err := n.refresh(key, element.Request); err != nil {
+			n.Log.Debug().Err(err).Msgf("failed to refresh %s", key.Name)
 		}
-		n.cache.Set(domain, resp)
 	}
 }
 
@@ -130,38 +202,77 @@ func CreateListener(addr string) (net.PacketConn, error) {
 	return net.ListenPacket("udp", addr)
 }
 
+// CreateTCPListener returns a TCP listener
+func CreateTCPListener(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
 func (n *Names) makeUpstreams() error {
 	for _, upstream := range viper.GetStringSlice("upstreams") {
-		server, sport, err := net.SplitHostPort(upstream)
-		if err != nil {
-			return err
-		}
-		port, err := strconv.Atoi(sport)
-		if err != nil {
-			return err
-		}
-		client, err := newClient(server, int16(port))
+		u, err := newUpstream(upstream, n.upstreamConfig())
 		if err != nil {
-			return err
+			return errors.Wrapf(err, "invalid upstream %s", upstream)
 		}
-		n.dnsUpstreams = append(n.dnsUpstreams, &Upstream{
-			addr:   upstream,
-			client: client,
-		})
+		n.dnsUpstreams = append(n.dnsUpstreams, u)
 	}
 	return nil
 }
 
+// background runs fn in a goroutine tracked by n.wg, fn has to return once n.ctx is done
+func (n *Names) background(fn func()) {
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		fn()
+	}()
+}
+
 // New Names instance
 func New(ctx context.Context, config *Config) (*Names, error) {
 	n := &Names{
-		ctx:  ctx,
-		Log:  makeLogger(config.LoggerConfig),
-		tree: trie.NewTrie(),
+		ctx:     ctx,
+		Log:     makeLogger(config.LoggerConfig),
+		fetcher: &lists.Fetcher{Sources: config.Sources},
+		config:  config,
+	}
+	if config.TCPIdleTimeout == 0 {
+		config.TCPIdleTimeout = defaultTCPIdleTimeout
+	}
+	if config.ResolveTimeout == 0 {
+		config.ResolveTimeout = defaultResolveTimeout
+	}
+	if config.UpstreamMaxFailures == 0 {
+		config.UpstreamMaxFailures = defaultUpstreamMaxFailures
+	}
+	if config.UpstreamProbeInterval == 0 {
+		config.UpstreamProbeInterval = defaultUpstreamProbeInterval
+	}
+	if config.BootstrapInterval == 0 {
+		config.BootstrapInterval = defaultBootstrapInterval
+	}
+	var err error
+	if n.block, err = newBlocker(config.BlockConfig); err != nil {
+		return nil, err
+	}
+	if n.bootstrap, err = newBootstrap(config.BootstrapResolvers, config.DNSClientTimeout); err != nil {
+		return nil, err
 	}
 	if err := n.makeUpstreams(); err != nil {
 		return nil, err
 	}
+	if err := n.makeForwards(); err != nil {
+		return nil, err
+	}
+	if n.bootstrap != nil {
+		n.background(n.refreshBootstrap)
+	}
+	if n.strategy, err = newStrategy(config.UpstreamStrategy); err != nil {
+		return nil, err
+	}
+	n.background(n.probeUpstreams)
+	if config.UpstreamStatusInterval > 0 {
+		n.background(n.reportUpstreams)
+	}
 
 	switch config.CacheConfig.RefreshCache {
 	case true:
@@ -170,28 +281,47 @@ func New(ctx context.Context, config *Config) (*Names, error) {
 		config.CacheConfig.RefreshFunc = n.dummyRefreshCacheFunc
 	}
 
-	var err error
 	n.cache, err = cache.New(*config.CacheConfig)
 	if err != nil {
 		return n, errors.Wrap(err, "failed to setup cache")
 	}
-	// update the blocklists
-	if n.tree, err = lists.Load(); err != nil {
-		return n, errors.Wrap(err, "failed to load blocklist")
+	if _, err := lists.Catalog(config.Sources); err != nil {
+		return n, errors.Wrap(err, "invalid list sources")
 	}
-	if fetchList := viper.GetStringSlice("fetch-lists"); len(fetchList) > 0 {
-		if err := lists.PopulateCache(n.tree, fetchList, n.Log); err != nil {
-			return n, errors.Wrap(err, "failed to fetch and update blocklists")
-		}
+	// build the lists from the sources, entries that were dropped from them since the last run are gone
+	if err := n.updateBlocklists(true); err != nil {
+		return n, errors.Wrap(err, "failed to build the block and allowlists")
+	}
+	if config.BlocklistRefreshInterval > 0 {
+		n.background(n.refreshBlocklists)
 	}
-	if err := lists.Dump(n.tree); err != nil {
-		return n, errors.Wrap(err, "failed to dump block list to file")
+	if err := n.watchBlockFiles(); err != nil {
+		return n, errors.Wrap(err, "failed to watch block files")
 	}
-	// create the listener
+	// create the listeners
 	n.PC, err = CreateListener(config.ListenerAddress)
 	if err != nil {
 		return n, errors.Wrap(err, "failed to create listener")
 	}
+	n.TCP, err = CreateTCPListener(config.ListenerAddress)
+	if err != nil {
+		return n, errors.Wrap(err, "failed to create tcp listener")
+	}
+	if config.DoHConfig != nil && config.DoHConfig.Address != "" {
+		if n.DoH, n.dohListener, err = n.createDoHServer(config.DoHConfig); err != nil {
+			return n, errors.Wrap(err, "failed to create doh server")
+		}
+		n.Log.Print("serving doh on ", config.DoHConfig.Address)
+	}
+	if config.DoTConfig != nil && config.DoTConfig.Address != "" {
+		if config.DoTConfig.IdleTimeout == 0 {
+			config.DoTConfig.IdleTimeout = config.TCPIdleTimeout
+		}
+		if n.DoT, err = CreateDoTListener(config.DoTConfig); err != nil {
+			return n, errors.Wrap(err, "failed to create dot listener")
+		}
+		n.Log.Print("serving dot on ", config.DoTConfig.Address)
+	}
 	n.Done = make(chan (bool))
 	n.Log.Print("serving on ", config.ListenerAddress)
 	return n, nil
@@ -207,12 +337,66 @@ func waitForSignals() {
 // Run the server
 func (n *Names) Run() {
 	go n.serve()
+	go n.serveTCP()
+	if n.DoH != nil {
+		go n.serveDoH(n.dohListener)
+	}
+	if n.DoT != nil {
+		go n.serveDoT()
+	}
 	waitForSignals()
 	n.PC.Close()
+	n.TCP.Close()
+	if n.DoH != nil {
+		n.DoH.Close()
+	}
+	if n.DoT != nil {
+		n.DoT.Close()
+	}
+}
+
+// ListMatch tells whether a name is blocked and which list entries decided it
+type ListMatch struct {
+	Blocked bool `json:"blocked"`
+	// Block is the blocklist entry the name matched, if any
+	Block *lists.Match `json:"block,omitempty"`
+	// Allow is the allowlist entry the name matched, it overrides Block
+	Allow *lists.Match `json:"allow,omitempty"`
 }
 
-func (n *Names) isBlocklisted(name string) bool {
-	return n.tree.Has(lists.ReverseString(strings.Trim(name, ".")))
+// LookupLists looks name up in the block and allowlists
+func (n *Names) LookupLists(name string) ListMatch {
+	var match ListMatch
+	if block, ok := n.blocklist().MatchDomain(name); ok {
+		match.Block = &block
+	}
+	if allow, ok := n.allowlist().Match(name); ok {
+		match.Allow = &allow
+	}
+	match.Blocked = match.Block != nil && match.Allow == nil
+	return match
+}
+
+// makeAllowlist builds an allowlist from the configured domains, the domains in the configured files
+// and the domains of the configured sources, which are read with populate
+func (n *Names) makeAllowlist(populate func(*lists.List, []string, *zerolog.Logger) error) (*lists.List, error) {
+	allowlist := lists.NewList()
+	for _, domain := range viper.GetStringSlice("allow") {
+		allowlist.Add(domain, lists.Origin{Source: "config"})
+	}
+	for _, path := range viper.GetStringSlice("allow-files") {
+		count, err := lists.LoadFile(allowlist, path)
+		if err != nil {
+			return nil, err
+		}
+		n.Log.Debug().Str("file", path).Msgf("added %d allowed domains", count)
+	}
+	if fetchList := viper.GetStringSlice("fetch-allowlists"); len(fetchList) > 0 {
+		if err := populate(allowlist, fetchList, n.Log); err != nil {
+			return nil, err
+		}
+	}
+	return allowlist, nil
 }
 
 func (n *Names) write(data []byte, pc net.PacketConn, addr net.Addr) error {
@@ -222,6 +406,17 @@ func (n *Names) write(data []byte, pc net.PacketConn, addr net.Addr) error {
 	return nil
 }
 
+// cacheKey returns the key the answer to req is cached under
+func cacheKey(req *fastdns.Message, opt edns) cache.Key {
+	return cache.Key{
+		Name:  strings.ToLower(string(req.Domain)),
+		Type:  uint16(req.Question.Type),
+		Class: uint16(req.Question.Class),
+		DO:    opt.do,
+		CD:    req.Header.Flags&0x0010 != 0,
+	}
+}
+
 func validateFast(msg *fastdns.Message) error {
 	if len(msg.Domain) == 0 {
 		return errors.New("no question")
@@ -241,91 +436,144 @@ func makeResponse(resp *fastdns.Message, addr string) (*fastdns.Message, error)
 }
 
 func (n *Names) handleUDP(buf []byte, pc net.PacketConn, addr net.Addr) error {
+	return n.handle(buf, true, func(data []byte) error {
+		return n.write(data, pc, addr)
+	})
+}
+
+// handle resolves the query in buf and passes the response to write.
+// Responses over UDP are truncated to the payload size negotiated with EDNS0.
+func (n *Names) handle(buf []byte, udp bool, write func(data []byte) error) error {
 	req := fastdns.AcquireMessage()
 	defer fastdns.ReleaseMessage(req)
 
 	if err := fastdns.ParseMessage(req, buf, true); err != nil {
+		if resp := errorResponse(buf, fastdns.RcodeFormErr); resp != nil {
+			if werr := write(resp); werr != nil {
+				return werr
+			}
+		}
 		return err
 	}
 
-	if err := validateFast(req); err != nil {
+	// never answer responses, that's how loops start
+	if req.Header.Flags.QR() == 1 {
+		return errors.New("received a response instead of a query")
+	}
+
+	opt, hasOPT := parseEDNS(req)
+	reply := func(data []byte) error {
+		data = setOPT(data, hasOPT, opt.do)
+		if size := maxResponseSize(udp, opt, hasOPT); len(data) > size {
+			var err error
+			if data, err = truncate(data, size); err != nil {
+				return err
+			}
+		}
+		return write(data)
+	}
+	// fail answers the query with rcode and passes on err
+	fail := func(rcode fastdns.Rcode, err error) error {
+		if werr := reply(errorResponse(buf, rcode)); werr != nil {
+			return werr
+		}
 		return err
 	}
 
+	if opcode := req.Header.Flags.Opcode(); opcode != fastdns.OpcodeQuery {
+		return fail(fastdns.RcodeNotImp, fmt.Errorf("unsupported opcode %s", opcode))
+	}
+
+	if err := validateFast(req); err != nil {
+		return fail(fastdns.RcodeFormErr, err)
+	}
+
 	n.Log.Debug().Msgf("lookup: %v", string(req.Domain))
 
 	// local lookup
 	if strings.TrimSpace(string(req.Domain)) == "local" {
+		n.queryLog(cacheKey(req, opt), "local").Msg("query")
 		resp, err := makeResponse(req, "127.0.0.1")
 		if err != nil {
-			return err
-		}
-		if err := n.write(resp.Raw, pc, addr); err != nil {
-			return err
+			return fail(fastdns.RcodeServFail, err)
 		}
-		return nil
+		return reply(resp.Raw)
+	}
+
+	key := cacheKey(req, opt)
+
+	// block list? Checked before the cache, so names are blocked as soon as they are listed
+	if match := n.LookupLists(key.Name); match.Blocked {
+		n.Log.Debug().Str("entry", match.Block.Entry).Interface("origins", match.Block.Origins).Msgf("%s did hit the blocklist", key.Name)
+		n.queryLog(key, "blocked").Str("entry", match.Block.Entry).Interface("origins", match.Block.Origins).Msg("query")
+		return reply(n.block.response(buf, req))
 	}
 
 	// cache hit?
-	if element, cacheHit := n.cache.Get(string(req.Domain)); cacheHit {
+	if element, cacheHit := n.cache.Get(key); cacheHit && element.Resolver != blockResolver {
 		n.Log.Debug().Msg("cache hit")
-		resp, err := makeResponse(req, element.Value)
-		if err != nil {
-			return err
-		}
-		if err := n.write(resp.Raw, pc, addr); err != nil {
+		n.queryLog(key, "cached").Str("resolver", element.Resolver).Msg("query")
+		resp := answerFor(element.Msg, req)
+		ageTTLs(resp, time.Since(element.TimeAdded), n.config.CacheConfig.ClampTTL)
+		if err := reply(resp); err != nil {
 			return err
 		}
 
-		// Let's update the cache with the latest resolution
-		if element.Refresh {
+		// update answers about to expire, so names in use don't drop out of the cache
+		if element.Refresh && expiresWithin(n.cache, element, element.TTL/refreshAhead) {
 			go func() {
-				element, err := n.resolveUpstream(req)
-				if err != nil {
-					// handle error?
+				if err := n.refresh(key, buf); err != nil {
+					n.Log.Debug().Err(err).Msgf("failed to refresh %s", key.Name)
 					return
 				}
-				n.Log.Debug().Msgf("Refreshed: %s", string(req.Domain))
-				n.cache.Set(string(req.Domain), element)
+				n.Log.Debug().Msgf("Refreshed: %s", key.Name)
 			}()
 		}
 		return nil
 	}
 
-	// block list?
-	if n.isBlocklisted(string(req.Domain)) {
-		n.Log.Debug().Msgf("%s did hit the blocklist", string(req.Domain))
-		resp, err := makeResponse(req, "127.0.0.1")
+	// regular resolve
+	element, err := n.lookup(key, req)
+	if err != nil {
+		n.queryLog(key, "failed").Err(err).Msg("query")
+		return fail(fastdns.RcodeServFail, err)
+	}
+	n.queryLog(key, "resolved").Str("resolver", element.Resolver).Msg("query")
+
+	resp := answerFor(element.Msg, req)
+	ageTTLs(resp, 0, n.config.CacheConfig.ClampTTL)
+	return reply(resp)
+}
+
+// lookup resolves req upstream and caches the answer under key.
+// Concurrent lookups of the same key share a single upstream exchange.
+func (n *Names) lookup(key cache.Key, req *fastdns.Message) (cache.Element, error) {
+	return n.flights.do(key, func() (cache.Element, error) {
+		element, err := n.resolveUpstream(req)
 		if err != nil {
-			return err
+			return element, err
 		}
-		if err := n.write(resp.Raw, pc, addr); err != nil {
-			return err
+		if element.TTL > 0 {
+			element.Refresh = true
+			n.cache.Set(key, element)
 		}
-		go func() {
-			// set cache since it was a cache miss
-			element := cache.Element{Value: "127.0.0.1", Refresh: false, Request: buf}
-			n.cache.Set(string(req.Domain), element)
-
-		}()
-		return nil
-	}
+		return element, nil
+	})
+}
 
-	// regular resolve
-	element, err := n.resolveUpstream(req)
-	if err != nil {
-		return err
-	}
+// expiresWithin reports whether element expires within d
+func expiresWithin(c *cache.Cache, element *cache.Element, d time.Duration) bool {
+	expires := c.Expires(element)
+	return !expires.IsZero() && time.Until(expires) < d
+}
 
-	resp, err := makeResponse(req, element.Value)
-	if err != nil {
+// refresh resolves the query in buf again and updates its cache entry
+func (n *Names) refresh(key cache.Key, buf []byte) error {
+	req := fastdns.AcquireMessage()
+	defer fastdns.ReleaseMessage(req)
+	if err := fastdns.ParseMessage(req, buf, true); err != nil {
 		return err
 	}
-
-	go func() {
-		element.Refresh = true
-		n.cache.Set(string(req.Domain), element)
-	}()
-
-	return n.write(resp.Raw, pc, addr)
+	_, err := n.lookup(key, req)
+	return err
 }
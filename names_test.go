@@ -1,20 +1,401 @@
 package names
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/glaslos/names/cache"
 	"github.com/glaslos/names/lists"
 
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/require"
 )
 
+func newTestNames(t *testing.T, configure ...func(cfg *Config)) *Names {
+	cfg := &Config{
+		ListenerAddress: "127.0.0.1:0",
+		LoggerConfig:    &LoggerConfig{},
+		CacheConfig:     &cache.Config{RefreshCache: false},
+	}
+	for _, fn := range configure {
+		fn(cfg)
+	}
+	// background work like watching block files stops with the test
+	ctx, cancel := context.WithCancel(context.Background())
+	n, err := New(ctx, cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		cancel()
+		n.wg.Wait()
+		n.PC.Close()
+		n.TCP.Close()
+		if n.DoT != nil {
+			n.DoT.Close()
+		}
+	})
+	return n
+}
+
 func TestIsBlocklisted(t *testing.T) {
 	cfg := &Config{LoggerConfig: &LoggerConfig{}, CacheConfig: &cache.Config{RefreshCache: false}}
 	n, err := New(context.Background(), cfg)
 	require.NoError(t, err)
 
-	n.tree.Add(lists.ReverseString("google.com"))
-	require.True(t, n.isBlocklisted("google.com"))
+	n.blocklist().Add("google.com", lists.Origin{Source: "test"})
+	require.NotNil(t, n.LookupLists("google.com").Block)
+	require.NotNil(t, n.LookupLists("mail.google.com").Block)
+	require.Nil(t, n.LookupLists("notgoogle.com").Block)
+}
+
+func TestAllowlist(t *testing.T) {
+	n := newTestNames(t)
+	withUpstream(t, n, func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg).SetReply(r)
+		a, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 192.0.2.1")
+		resp.Answer = append(resp.Answer, a)
+		w.WriteMsg(resp)
+	})
+	for _, domain := range []string{"ads.example.com", "cdn.example.com", "example.net", "ads.example.org"} {
+		n.blocklist().Add(domain, lists.Origin{Source: "test"})
+	}
+	n.allowlist().Add("*.example.com", lists.Origin{Source: "test"})
+	n.allowlist().Add("example.net", lists.Origin{Source: "test"})
+
+	for name, blocked := range map[string]bool{
+		"ads.example.com.": false,
+		"cdn.example.com.": false,
+		"example.net.":     false,
+		"ads.example.org.": true,
+	} {
+		resp := query(t, n, new(dns.Msg).SetQuestion(name, dns.TypeA))
+		require.Equal(t, blocked, resp.Answer[0].(*dns.A).A.String() == "0.0.0.0", name)
+	}
+	require.Nil(t, n.LookupLists("example.com").Allow)
+	require.Nil(t, n.LookupLists("www.example.net").Allow)
+}
+
+func TestLookupLists(t *testing.T) {
+	n := newTestNames(t, func(cfg *Config) {
+		cfg.LoggerConfig.Queries = true
+	})
+	var logs bytes.Buffer
+	logger := zerolog.New(&logs)
+	n.Log = &logger
+	n.blocklist().Add("doubleclick.net", lists.Origin{Source: "adguard", Line: 12})
+	n.allowlist().Add("good.doubleclick.net", lists.Origin{Source: "config"})
+
+	match := n.LookupLists("ad.doubleclick.net")
+	require.True(t, match.Blocked)
+	require.Equal(t, &lists.Match{Entry: "doubleclick.net", Origins: []lists.Origin{{Source: "adguard", Line: 12}}}, match.Block)
+	require.Nil(t, match.Allow)
+
+	match = n.LookupLists("good.doubleclick.net")
+	require.False(t, match.Blocked)
+	require.Equal(t, "doubleclick.net", match.Block.Entry)
+	require.Equal(t, "good.doubleclick.net", match.Allow.Entry)
+
+	require.False(t, n.LookupLists("example.com").Blocked)
+
+	query(t, n, new(dns.Msg).SetQuestion("ad.doubleclick.net.", dns.TypeA))
+	require.Contains(t, logs.String(), `"name":"ad.doubleclick.net","type":"A","result":"blocked","entry":"doubleclick.net","origins":[{"source":"adguard","line":12}]`)
+}
+
+// query sends msg through the resolution pipeline and returns the unpacked response
+func query(t *testing.T, n *Names, msg *dns.Msg) *dns.Msg {
+	buf, err := msg.Pack()
+	require.NoError(t, err)
+	resp := new(dns.Msg)
+	require.NoError(t, n.handle(buf, true, func(data []byte) error {
+		return resp.Unpack(data)
+	}))
+	return resp
+}
+
+// newTestUpstream returns an upstream for a fake upstream answering with handler
+func newTestUpstream(t *testing.T, handler dns.HandlerFunc) *Upstream {
+	u, err := newUpstream(newFakeUpstream(t, handler), upstreamConfig{})
+	require.NoError(t, err)
+	return u
+}
+
+// withUpstream makes a fake upstream answering with handler the only upstream of n
+func withUpstream(t *testing.T, n *Names, handler dns.HandlerFunc) {
+	n.dnsUpstreams = []*Upstream{newTestUpstream(t, handler)}
+}
+
+func TestPassthrough(t *testing.T) {
+	n := newTestNames(t)
+	withUpstream(t, n, func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg).SetReply(r)
+		switch r.Question[0].Name {
+		case "example.com.":
+			mx, _ := dns.NewRR("example.com. 3600 IN MX 10 mail.example.com.")
+			ns, _ := dns.NewRR("example.com. 3600 IN NS ns.example.com.")
+			a, _ := dns.NewRR("mail.example.com. 3600 IN A 192.0.2.1")
+			resp.Answer = append(resp.Answer, mx)
+			resp.Ns = append(resp.Ns, ns)
+			resp.Extra = append(resp.Extra, a)
+		default:
+			resp.SetRcode(r, dns.RcodeNameError)
+		}
+		w.WriteMsg(resp)
+	})
+
+	resp := query(t, n, new(dns.Msg).SetQuestion("example.com.", dns.TypeMX))
+	require.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	require.Len(t, resp.Answer, 1)
+	require.Equal(t, "mail.example.com.", resp.Answer[0].(*dns.MX).Mx)
+	require.Len(t, resp.Ns, 1)
+	require.Len(t, resp.Extra, 1)
+
+	resp = query(t, n, new(dns.Msg).SetQuestion("missing.example.com.", dns.TypeTXT))
+	require.Equal(t, dns.RcodeNameError, resp.Rcode)
+}
+
+func TestCachePerType(t *testing.T) {
+	n := newTestNames(t)
+	withUpstream(t, n, func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg).SetReply(r)
+		rr, _ := dns.NewRR("example.com. 300 IN A 192.0.2.1")
+		if r.Question[0].Qtype == dns.TypeAAAA {
+			rr, _ = dns.NewRR("example.com. 300 IN AAAA 2001:db8::1")
+		}
+		resp.Answer = append(resp.Answer, rr)
+		w.WriteMsg(resp)
+	})
+
+	resp := query(t, n, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	require.IsType(t, &dns.A{}, resp.Answer[0])
+	require.Eventually(t, func() bool {
+		_, ok := n.cache.Get(cache.Key{Name: "example.com", Type: dns.TypeA, Class: dns.ClassINET})
+		return ok
+	}, time.Second, 10*time.Millisecond)
+
+	resp = query(t, n, new(dns.Msg).SetQuestion("Example.com.", dns.TypeAAAA))
+	require.IsType(t, &dns.AAAA{}, resp.Answer[0])
+	require.Equal(t, "Example.com.", resp.Question[0].Name)
+}
+
+func TestRefreshCache(t *testing.T) {
+	n := newTestNames(t)
+	n.config.CacheConfig.RefreshInterval = 2 * time.Second
+	var mu sync.Mutex
+	queries := map[string]int{}
+	withUpstream(t, n, func(w dns.ResponseWriter, r *dns.Msg) {
+		name := r.Question[0].Name
+		mu.Lock()
+		queries[name]++
+		mu.Unlock()
+		ttl := "300"
+		if strings.HasPrefix(name, "expiring.") {
+			ttl = "1"
+		}
+		resp := new(dns.Msg).SetReply(r)
+		a, _ := dns.NewRR(name + " " + ttl + " IN A 192.0.2.1")
+		resp.Answer = append(resp.Answer, a)
+		w.WriteMsg(resp)
+	})
+	count := func(name string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return queries[name]
+	}
+	for _, name := range []string{"fresh.example.com.", "expiring.example.com."} {
+		query(t, n, new(dns.Msg).SetQuestion(name, dns.TypeA))
+		require.Eventually(t, func() bool {
+			_, ok := n.cache.Get(cache.Key{Name: strings.TrimSuffix(name, "."), Type: dns.TypeA, Class: dns.ClassINET})
+			return ok
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	// hits only refresh answers about to expire
+	query(t, n, new(dns.Msg).SetQuestion("fresh.example.com.", dns.TypeA))
+	require.Equal(t, 1, count("fresh.example.com."))
+
+	// the refresh runs while queries write to the cache and only refreshes the answers expiring before its next run
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n.refreshCacheFunc(n.cache)
+	}()
+	for i := 0; i < 10; i++ {
+		query(t, n, new(dns.Msg).SetQuestion(fmt.Sprintf("other%d.example.com.", i), dns.TypeA))
+	}
+	<-done
+	require.Equal(t, 1, count("fresh.example.com."))
+	require.Equal(t, 2, count("expiring.example.com."))
+}
+
+func TestNegativeCaching(t *testing.T) {
+	var queries atomic.Int32
+	n := newTestNames(t)
+	withUpstream(t, n, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		resp := new(dns.Msg).SetReply(r)
+		switch r.Question[0].Name {
+		case "nxdomain.example.com.":
+			resp.Rcode = dns.RcodeNameError
+		case "nosoa.example.com.":
+			resp.Rcode = dns.RcodeNameError
+			w.WriteMsg(resp)
+			return
+		}
+		soa, _ := dns.NewRR("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 3600 1209600 60")
+		resp.Ns = append(resp.Ns, soa)
+		w.WriteMsg(resp)
+	})
+
+	for _, test := range []struct {
+		name  string
+		rcode int
+	}{
+		{"nxdomain.example.com.", dns.RcodeNameError},
+		{"nodata.example.com.", dns.RcodeSuccess},
+	} {
+		resp := query(t, n, new(dns.Msg).SetQuestion(test.name, dns.TypeA))
+		require.Equal(t, test.rcode, resp.Rcode)
+		require.Empty(t, resp.Answer)
+		require.Equal(t, uint32(60), resp.Ns[0].Header().Ttl)
+
+		key := cache.Key{Name: strings.TrimSuffix(test.name, "."), Type: dns.TypeA, Class: dns.ClassINET}
+		require.Eventually(t, func() bool {
+			element, ok := n.cache.Get(key)
+			return ok && element.TTL == time.Minute
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	// served from the cache without asking upstream again
+	before := queries.Load()
+	resp := query(t, n, new(dns.Msg).SetQuestion("nxdomain.example.com.", dns.TypeA))
+	require.Equal(t, dns.RcodeNameError, resp.Rcode)
+	require.Equal(t, before, queries.Load())
+
+	// no SOA, no caching
+	resp = query(t, n, new(dns.Msg).SetQuestion("nosoa.example.com.", dns.TypeA))
+	require.Equal(t, dns.RcodeNameError, resp.Rcode)
+	time.Sleep(50 * time.Millisecond)
+	_, ok := n.cache.Get(cache.Key{Name: "nosoa.example.com", Type: dns.TypeA, Class: dns.ClassINET})
+	require.False(t, ok)
+}
+
+func TestErrorResponses(t *testing.T) {
+	n := newTestNames(t)
+	withUpstream(t, n, func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(new(dns.Msg).SetRcode(r, dns.RcodeRefused))
+	})
+
+	handle := func(buf []byte) *dns.Msg {
+		var resp *dns.Msg
+		require.Error(t, n.handle(buf, true, func(data []byte) error {
+			resp = new(dns.Msg)
+			return resp.Unpack(data)
+		}))
+		require.NotNil(t, resp)
+		return resp
+	}
+
+	// a header without a question
+	resp := handle([]byte{0xbe, 0xef, 0x01, 0x00, 0, 0, 0, 0, 0, 0, 0, 0})
+	require.Equal(t, uint16(0xbeef), resp.Id)
+	require.Equal(t, dns.RcodeFormatError, resp.Rcode)
+	require.True(t, resp.Response)
+
+	msg := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	msg.Opcode = dns.OpcodeStatus
+	buf, err := msg.Pack()
+	require.NoError(t, err)
+	resp = handle(buf)
+	require.Equal(t, msg.Id, resp.Id)
+	require.Equal(t, dns.RcodeNotImplemented, resp.Rcode)
+	require.Equal(t, msg.Question, resp.Question)
+
+	msg = new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	buf, err = msg.SetEdns0(4096, false).Pack()
+	require.NoError(t, err)
+	resp = handle(buf)
+	require.Equal(t, msg.Id, resp.Id)
+	require.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+	require.Equal(t, msg.Question, resp.Question)
+	require.True(t, resp.RecursionDesired)
+	require.NotNil(t, resp.IsEdns0())
+
+	// responses are dropped
+	msg.Response = true
+	buf, err = msg.Pack()
+	require.NoError(t, err)
+	require.Error(t, n.handle(buf, true, func(data []byte) error {
+		t.Fatal("answered a response")
+		return nil
+	}))
+}
+
+func TestCoalescing(t *testing.T) {
+	var queries atomic.Int32
+	n := newTestNames(t)
+	withUpstream(t, n, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		resp := new(dns.Msg).SetReply(r)
+		rr, _ := dns.NewRR("example.com. 300 IN A 192.0.2.1")
+		resp.Answer = append(resp.Answer, rr)
+		w.WriteMsg(resp)
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+			resp := query(t, n, msg)
+			require.Equal(t, msg.Id, resp.Id)
+			require.Len(t, resp.Answer, 1)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), queries.Load())
+}
+
+func TestForwarding(t *testing.T) {
+	answer := func(ip string) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, r *dns.Msg) {
+			resp := new(dns.Msg).SetReply(r)
+			a, _ := dns.NewRR(r.Question[0].Name + " 60 IN A " + ip)
+			resp.Answer = append(resp.Answer, a)
+			w.WriteMsg(resp)
+		}
+	}
+	n := newTestNames(t)
+	for ip, zone := range map[string]string{
+		"192.0.2.1": "",
+		"192.0.2.2": "corp.internal",
+		"192.0.2.3": "dev.corp.internal",
+	} {
+		u := newTestUpstream(t, answer(ip))
+		if zone == "" {
+			n.dnsUpstreams = []*Upstream{u}
+			continue
+		}
+		n.forwards[zone] = []*Upstream{u}
+	}
+
+	for name, ip := range map[string]string{
+		"example.com.":               "192.0.2.1",
+		"corp.internal.":             "192.0.2.2",
+		"HOST.Corp.Internal.":        "192.0.2.2",
+		"host.dev.corp.internal.":    "192.0.2.3",
+		"host.notcorp.internal.":     "192.0.2.1",
+		"dev.corp.internal.example.": "192.0.2.1",
+	} {
+		resp := query(t, n, new(dns.Msg).SetQuestion(name, dns.TypeA))
+		require.Len(t, resp.Answer, 1, name)
+		require.Equal(t, ip, resp.Answer[0].(*dns.A).A.String(), name)
+	}
 }
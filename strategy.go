@@ -0,0 +1,153 @@
+package names
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+
+	"github.com/glaslos/names/cache"
+
+	"github.com/phuslu/fastdns"
+)
+
+// exchangeFunc queries a single upstream
+type exchangeFunc func(ctx context.Context, req *fastdns.Message, upstream *Upstream) (cache.Element, error)
+
+// strategy decides which upstreams a query is sent to and in which order
+type strategy interface {
+	resolve(ctx context.Context, req *fastdns.Message, upstreams []*Upstream, exchange exchangeFunc) (cache.Element, error)
+}
+
+// newStrategy returns the strategy with the given name
+func newStrategy(name string) (strategy, error) {
+	switch name {
+	case "", "race":
+		return raceStrategy{}, nil
+	case "round-robin":
+		return &roundRobinStrategy{}, nil
+	case "fastest":
+		return fastestStrategy{}, nil
+	case "sequential":
+		return sequentialStrategy{}, nil
+	case "random":
+		return randomStrategy{}, nil
+	}
+	return nil, fmt.Errorf("unknown upstream strategy %q", name)
+}
+
+// failover tries upstreams one after the other until one answers or ctx is done
+func failover(ctx context.Context, req *fastdns.Message, upstreams []*Upstream, exchange exchangeFunc) (cache.Element, error) {
+	var errs []error
+	for _, upstream := range upstreams {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		element, err := exchange(ctx, req, upstream)
+		if err == nil {
+			return element, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", upstream.addr, err))
+	}
+	return cache.Element{}, fmt.Errorf("all upstreams failed: %w", errors.Join(errs...))
+}
+
+// raceStrategy sends the query to all upstreams at once and takes the first answer
+type raceStrategy struct{}
+
+func (raceStrategy) resolve(ctx context.Context, req *fastdns.Message, upstreams []*Upstream, exchange exchangeFunc) (cache.Element, error) {
+	dataCh := make(chan cache.Element)
+	errCh := make(chan error)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	for _, upstream := range upstreams {
+		go func(upstream *Upstream) {
+			element, err := exchange(ctx, req, upstream)
+			if err != nil {
+				select {
+				case <-stopCh:
+				case errCh <- err:
+				}
+				return
+			}
+			select {
+			case <-stopCh:
+			case dataCh <- element:
+			}
+		}(upstream)
+	}
+	for failed := 0; failed < len(upstreams); {
+		select {
+		case <-ctx.Done():
+			return cache.Element{}, errors.New("resolve upstream timeout")
+		case element := <-dataCh:
+			return element, nil
+		case <-errCh:
+			failed++
+		}
+	}
+	return cache.Element{}, errors.New("all upstreams failed")
+}
+
+// roundRobinStrategy starts each query at the upstream after the one the previous query started at
+type roundRobinStrategy struct {
+	next atomic.Uint64
+}
+
+func (s *roundRobinStrategy) resolve(ctx context.Context, req *fastdns.Message, upstreams []*Upstream, exchange exchangeFunc) (cache.Element, error) {
+	start := int((s.next.Add(1) - 1) % uint64(len(upstreams)))
+	ordered := make([]*Upstream, 0, len(upstreams))
+	ordered = append(append(ordered, upstreams[start:]...), upstreams[:start]...)
+	return failover(ctx, req, ordered, exchange)
+}
+
+// fastestStrategy prefers the upstream with the lowest average latency.
+// Upstreams without samples go first so every upstream gets measured.
+type fastestStrategy struct{}
+
+func (fastestStrategy) resolve(ctx context.Context, req *fastdns.Message, upstreams []*Upstream, exchange exchangeFunc) (cache.Element, error) {
+	ordered := append([]*Upstream(nil), upstreams...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Latency() < ordered[j].Latency()
+	})
+	return failover(ctx, req, ordered, exchange)
+}
+
+// sequentialStrategy always tries the upstreams in the configured order
+type sequentialStrategy struct{}
+
+func (sequentialStrategy) resolve(ctx context.Context, req *fastdns.Message, upstreams []*Upstream, exchange exchangeFunc) (cache.Element, error) {
+	return failover(ctx, req, upstreams, exchange)
+}
+
+// randomStrategy picks upstreams at random, proportional to their weight
+type randomStrategy struct{}
+
+func (randomStrategy) resolve(ctx context.Context, req *fastdns.Message, upstreams []*Upstream, exchange exchangeFunc) (cache.Element, error) {
+	return failover(ctx, req, weightedShuffle(upstreams), exchange)
+}
+
+// weightedShuffle returns the upstreams in a random order where heavier upstreams tend to come first
+func weightedShuffle(upstreams []*Upstream) []*Upstream {
+	remaining := append([]*Upstream(nil), upstreams...)
+	total := 0
+	for _, upstream := range remaining {
+		total += upstream.weight
+	}
+	ordered := make([]*Upstream, 0, len(remaining))
+	for len(remaining) > 0 {
+		pick := rand.Intn(total)
+		for i, upstream := range remaining {
+			if pick -= upstream.weight; pick < 0 {
+				ordered = append(ordered, upstream)
+				total -= upstream.weight
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+	}
+	return ordered
+}
@@ -0,0 +1,138 @@
+package names
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/phuslu/fastdns"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeExchanger answers every query with an A record after delay, or fails
+type fakeExchanger struct {
+	delay time.Duration
+	fail  bool
+	calls atomic.Int32
+}
+
+func (f *fakeExchanger) Exchange(ctx context.Context, req, resp *fastdns.Message) error {
+	f.calls.Add(1)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(f.delay):
+	}
+	if f.fail {
+		return errors.New("fake upstream failure")
+	}
+	resp.Raw = append(resp.Raw[:0], req.Raw...)
+	if err := fastdns.ParseMessage(resp, resp.Raw, false); err != nil {
+		return err
+	}
+	resp.SetResponseHeader(fastdns.RcodeNoError, 1)
+	resp.Raw = fastdns.AppendHOSTRecord(resp.Raw, resp, 60, []netip.Addr{netip.MustParseAddr("192.0.2.1")})
+	return nil
+}
+
+func newFakeUpstreams(fakes ...*fakeExchanger) []*Upstream {
+	upstreams := make([]*Upstream, len(fakes))
+	for i, fake := range fakes {
+		upstreams[i] = &Upstream{addr: string(rune('a' + i)), client: fake, weight: 1}
+	}
+	return upstreams
+}
+
+func resolveWith(t *testing.T, s strategy, upstreams []*Upstream) (string, error) {
+	req := &fastdns.Message{}
+	req.SetRequestQuestion("example.com", fastdns.TypeA, fastdns.ClassINET)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	element, err := s.resolve(ctx, req, upstreams, exchange)
+	return element.Resolver, err
+}
+
+func TestNewStrategy(t *testing.T) {
+	for _, name := range []string{"", "race", "round-robin", "fastest", "sequential", "random"} {
+		_, err := newStrategy(name)
+		require.NoError(t, err)
+	}
+	_, err := newStrategy("banana")
+	require.Error(t, err)
+}
+
+func TestRaceStrategy(t *testing.T) {
+	upstreams := newFakeUpstreams(&fakeExchanger{delay: 200 * time.Millisecond}, &fakeExchanger{}, &fakeExchanger{fail: true})
+	resolver, err := resolveWith(t, raceStrategy{}, upstreams)
+	require.NoError(t, err)
+	require.Equal(t, "b", resolver)
+
+	_, err = resolveWith(t, raceStrategy{}, newFakeUpstreams(&fakeExchanger{fail: true}, &fakeExchanger{fail: true}))
+	require.Error(t, err)
+}
+
+func TestRoundRobinStrategy(t *testing.T) {
+	s := &roundRobinStrategy{}
+	upstreams := newFakeUpstreams(&fakeExchanger{}, &fakeExchanger{}, &fakeExchanger{fail: true})
+	var resolvers []string
+	for i := 0; i < 4; i++ {
+		resolver, err := resolveWith(t, s, upstreams)
+		require.NoError(t, err)
+		resolvers = append(resolvers, resolver)
+	}
+	// the failing third upstream hands over to the first
+	require.Equal(t, []string{"a", "b", "a", "a"}, resolvers)
+}
+
+func TestFastestStrategy(t *testing.T) {
+	slow, fast := &fakeExchanger{delay: 50 * time.Millisecond}, &fakeExchanger{}
+	upstreams := newFakeUpstreams(slow, fast)
+	// the first queries measure both upstreams
+	for i := 0; i < 2; i++ {
+		_, err := resolveWith(t, fastestStrategy{}, upstreams)
+		require.NoError(t, err)
+	}
+	for i := 0; i < 5; i++ {
+		resolver, err := resolveWith(t, fastestStrategy{}, upstreams)
+		require.NoError(t, err)
+		require.Equal(t, "b", resolver)
+	}
+	require.Equal(t, int32(1), slow.calls.Load())
+	require.Less(t, upstreams[1].Latency(), upstreams[0].Latency())
+}
+
+func TestSequentialStrategy(t *testing.T) {
+	failing := &fakeExchanger{fail: true}
+	upstreams := newFakeUpstreams(failing, &fakeExchanger{}, &fakeExchanger{})
+	for i := 0; i < 3; i++ {
+		resolver, err := resolveWith(t, sequentialStrategy{}, upstreams)
+		require.NoError(t, err)
+		require.Equal(t, "b", resolver)
+	}
+	require.Equal(t, int32(3), failing.calls.Load())
+}
+
+func TestRandomStrategy(t *testing.T) {
+	light, heavy := &fakeExchanger{}, &fakeExchanger{}
+	upstreams := newFakeUpstreams(light, heavy)
+	upstreams[1].weight = 9
+	for i := 0; i < 1000; i++ {
+		_, err := resolveWith(t, randomStrategy{}, upstreams)
+		require.NoError(t, err)
+	}
+	require.Equal(t, int32(1000), light.calls.Load()+heavy.calls.Load())
+	require.Greater(t, heavy.calls.Load(), int32(750))
+}
+
+func TestUpstreamWeight(t *testing.T) {
+	u, err := newUpstream("9.9.9.9:53@3", upstreamConfig{})
+	require.NoError(t, err)
+	require.Equal(t, "9.9.9.9:53", u.addr)
+	require.Equal(t, 3, u.weight)
+
+	_, err = newUpstream("9.9.9.9:53@0", upstreamConfig{})
+	require.Error(t, err)
+}
@@ -0,0 +1,122 @@
+package names
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultTCPIdleTimeout = 10 * time.Second
+
+// serveTCP accepts DNS over TCP connections
+func (n *Names) serveTCP() {
+	n.serveStream(n.TCP, n.config.TCPIdleTimeout, 0)
+	n.Log.Print("tcp loop closed")
+}
+
+// serveStream accepts connections speaking length-prefixed DNS on ln.
+// With maxConns > 0 no new connections are accepted while maxConns are open.
+func (n *Names) serveStream(ln net.Listener, idleTimeout time.Duration, maxConns int) {
+	var sem chan struct{}
+	if maxConns > 0 {
+		sem = make(chan struct{}, maxConns)
+	}
+	for {
+		if sem != nil {
+			sem <- struct{}{}
+		}
+		conn, err := ln.Accept()
+		if err != nil {
+			if sem != nil {
+				<-sem
+			}
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				continue
+			}
+			if !errors.Is(err, net.ErrClosed) {
+				n.Log.Print(err)
+			}
+			break
+		}
+		go func() {
+			n.handleTCPConn(conn, idleTimeout)
+			if sem != nil {
+				<-sem
+			}
+		}()
+	}
+}
+
+// handleTCPConn reads pipelined queries from conn until the client disconnects or goes idle.
+// Responses are written in the order they are resolved, not in the order they were received.
+func (n *Names) handleTCPConn(conn net.Conn, idleTimeout time.Duration) {
+	defer conn.Close()
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	write := func(data []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := conn.SetWriteDeadline(time.Now().Add(idleTimeout)); err != nil {
+			return err
+		}
+		return writeTCPMsg(conn, data)
+	}
+
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(idleTimeout)); err != nil {
+			break
+		}
+		buf, err := readTCPMsg(conn)
+		if err != nil {
+			// EOF and idle timeouts are the regular ways for a connection to end
+			if !errors.Is(err, io.EOF) && !os.IsTimeout(err) {
+				n.Log.Debug().Err(err).Msg("failed to read tcp query")
+			}
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := n.handle(buf, false, write); err != nil {
+				n.Log.Error().Err(err).Msg("failed to handle request")
+			}
+		}()
+	}
+	// let in-flight queries answer before closing the connection
+	wg.Wait()
+}
+
+// readTCPMsg reads a single two byte length-prefixed DNS message
+func readTCPMsg(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// writeTCPMsg writes data prefixed with its two byte length
+func writeTCPMsg(w io.Writer, data []byte) error {
+	if len(data) > math.MaxUint16 {
+		return errors.New("message too large for tcp")
+	}
+	buf := make([]byte, 2, 2+len(data))
+	binary.BigEndian.PutUint16(buf, uint16(len(data)))
+	if _, err := w.Write(append(buf, data...)); err != nil {
+		return fmt.Errorf("failed to write msg: %w", err)
+	}
+	return nil
+}
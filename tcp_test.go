@@ -0,0 +1,38 @@
+package names
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTCPPipelined(t *testing.T) {
+	n := newTestNames(t)
+	go n.serveTCP()
+
+	conn, err := net.Dial("tcp", n.TCP.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	ids := map[uint16]bool{}
+	for i := 0; i < 2; i++ {
+		msg := new(dns.Msg).SetQuestion("local.", dns.TypeA)
+		buf, err := msg.Pack()
+		require.NoError(t, err)
+		require.NoError(t, writeTCPMsg(conn, buf))
+		ids[msg.Id] = true
+	}
+	for i := 0; i < 2; i++ {
+		buf, err := readTCPMsg(conn)
+		require.NoError(t, err)
+		resp := new(dns.Msg)
+		require.NoError(t, resp.Unpack(buf))
+		require.True(t, ids[resp.Id])
+		require.Len(t, resp.Answer, 1)
+		require.Equal(t, "127.0.0.1", resp.Answer[0].(*dns.A).A.String())
+	}
+}